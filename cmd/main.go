@@ -5,9 +5,7 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -16,14 +14,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/mainflux/export/pkg/config"
 	exp "github.com/mainflux/export/pkg/config"
 	"github.com/mainflux/export/pkg/export"
 	"github.com/mainflux/export/pkg/export/api"
+	"github.com/mainflux/export/pkg/messages"
+	filecache "github.com/mainflux/export/pkg/messages/file"
+	cache "github.com/mainflux/export/pkg/messages/redis"
 	"github.com/mainflux/mainflux"
 	"github.com/mainflux/mainflux/logger"
-	"github.com/mainflux/mainflux/pkg/errors"
-	"github.com/mainflux/mainflux/pkg/messaging"
 	"github.com/mainflux/mainflux/pkg/messaging/brokers"
 	nats "github.com/nats-io/nats.go"
 )
@@ -44,11 +44,27 @@ const (
 	defMqttRetain     = "false"
 	defMqttCert       = "thing.cert"
 	defMqttPrivKey    = "thing.key"
+	defMqttTLSMode    = ""
+	defMqttServerName = ""
+	defMqttMinTLS     = ""
+	defMqttP12        = ""
+	defMqttPassFile   = ""
+	defMqttWSPath     = ""
+	defMqttProxy      = ""
+	defMqttClientID   = ""
+	defMqttPersistent = "false"
+	defMqttStoreDir   = ""
 	defConfigFile     = "../configs/config.toml"
 
 	defCacheURL  = "localhost:6379"
 	defCachePass = ""
 	defCacheDB   = "0"
+	defCacheType = "redis"
+	defCacheDir  = "cache"
+
+	defShutdownTimeout = "30s"
+	defInstanceID      = ""
+	defMaxHops         = "0"
 
 	envBrokerURL = "MF_BROKER_URL"
 	envLogLevel  = "MF_EXPORT_LOG_LEVEL"
@@ -65,14 +81,31 @@ const (
 	envMqttRetain     = "MF_EXPORT_MQTT_RETAIN"
 	envMqttCert       = "MF_EXPORT_MQTT_CLIENT_CERT"
 	envMqttPrivKey    = "MF_EXPORT_MQTT_CLIENT_PK"
+	envMqttTLSMode    = "MF_EXPORT_MQTT_TLS_MODE"
+	envMqttServerName = "MF_EXPORT_MQTT_SERVER_NAME"
+	envMqttMinTLS     = "MF_EXPORT_MQTT_MIN_TLS_VERSION"
+	envMqttP12        = "MF_EXPORT_MQTT_CLIENT_P12"
+	envMqttPassFile   = "MF_EXPORT_MQTT_KEY_PASSPHRASE_FILE"
+	envMqttPass       = "MF_EXPORT_MQTT_KEY_PASSPHRASE"
+	envMqttWSPath     = "MF_EXPORT_MQTT_WS_PATH"
+	envMqttProxy      = "MF_EXPORT_MQTT_PROXY"
+	envMqttClientID   = "MF_EXPORT_MQTT_CLIENT_ID"
+	envMqttPersistent = "MF_EXPORT_MQTT_PERSISTENT_SESSION"
+	envMqttStoreDir   = "MF_EXPORT_MQTT_STORE_DIR"
 	envConfigFile     = "MF_EXPORT_CONFIG_FILE"
 
 	envCacheURL  = "MF_EXPORT_CACHE_URL"
 	envCachePass = "MF_EXPORT_CACHE_PASS"
 	envCacheDB   = "MF_EXPORT_CACHE_DB"
+	envCacheType = "MF_EXPORT_CACHE_TYPE"
+	envCacheDir  = "MF_EXPORT_CACHE_DIR"
+
+	envShutdownTimeout = "MF_EXPORT_SHUTDOWN_TIMEOUT"
+	envInstanceID      = "MF_EXPORT_INSTANCE_ID"
+	envMaxHops         = "MF_EXPORT_MAX_HOPS"
 
-	heartbeatSubject = "heartbeat"
-	service          = "service"
+	cacheTypeRedis = "redis"
+	cacheTypeFile  = "file"
 )
 
 func main() {
@@ -93,7 +126,13 @@ func main() {
 	}
 	defer pubsub.Close()
 
-	svc, err := export.New(cfg, logger, pubsub)
+	msgCache, closeCache, err := newCache(cfg.Server, logger)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to setup cache: %s", err))
+	}
+	defer closeCache()
+
+	svc, err := export.New(cfg, msgCache, logger, pubsub)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to create service :%s", err))
 		return
@@ -104,28 +143,85 @@ func main() {
 	}
 	svc.Subscribe(ctx)
 
-	// Publish heartbeat
-	ticker := time.NewTicker(10000 * time.Millisecond)
-	go func() {
-		subject := fmt.Sprintf("%s.%s.%s", heartbeatSubject, svcName, service)
-		for range ticker.C {
-			if err := pubsub.Publish(ctx, subject, &messaging.Message{Channel: subject}); err != nil {
-				logger.Error(fmt.Sprintf("Failed to publish heartbeat, %s", err))
-			}
-		}
-	}()
-
 	errs := make(chan error, 2)
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	go startHTTPService(svc, cfg.Server.Port, logger, errs)
 
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	go watchConfig(watchCtx, svc, cfg.File, logger)
+
 	err = <-errs
 	logger.Error(fmt.Sprintf("export writer service terminated: %s", err))
+	shutdown(svc, cfg.Server, logger)
+}
+
+// watchConfig reloads the configuration when config file changes or SIGHUP is received.
+func watchConfig(ctx context.Context, svc export.Service, file string, logger logger.Logger) {
+	reloads := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		if err := config.Watch(ctx, file, trigger); err != nil {
+			logger.Error(fmt.Sprintf("Stopped watching config file %s: %s", file, err))
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP")
+			trigger()
+		case <-reloads:
+			if err := reloadConfig(svc, file); err != nil {
+				logger.Error(fmt.Sprintf("Rejected config file %s, keeping running configuration: %s", file, err))
+				continue
+			}
+			logger.Info(fmt.Sprintf("Configuration reloaded from file %s", file))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func reloadConfig(svc export.Service, file string) error {
+	cfg, err := config.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return svc.Reload(cfg)
+}
+
+func shutdown(svc export.Service, cfg exp.Server, logger logger.Logger) {
+	if cfg.ShutdownTimeout == "" {
+		cfg.ShutdownTimeout = defShutdownTimeout
+	}
+	timeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		timeout, _ = time.ParseDuration(defShutdownTimeout)
+		logger.Warn(fmt.Sprintf("Invalid shutdown timeout %q, using %s", cfg.ShutdownTimeout, timeout))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Failed to shutdown gracefully: %s", err))
+		return
+	}
+	logger.Info("Export service shut down gracefully")
 }
 
 func loadConfigs() (exp.Config, error) {
@@ -144,6 +240,10 @@ func loadConfigs() (exp.Config, error) {
 		if err != nil {
 			mqttRetain = false
 		}
+		mqttPersistent, err := strconv.ParseBool(mainflux.Env(envMqttPersistent, defMqttPersistent))
+		if err != nil {
+			mqttPersistent = false
+		}
 
 		q, err := strconv.ParseInt(mainflux.Env(envMqttQoS, defMqttQoS), 10, 64)
 		if err != nil {
@@ -151,6 +251,11 @@ func loadConfigs() (exp.Config, error) {
 		}
 		QoS := int(q)
 
+		maxHops, err := strconv.Atoi(mainflux.Env(envMaxHops, defMaxHops))
+		if err != nil {
+			maxHops = 0
+		}
+
 		sc := exp.Server{
 			BrokerURL: mainflux.Env(envBrokerURL, defBrokerURL),
 			LogLevel:  mainflux.Env(envLogLevel, defLogLevel),
@@ -158,6 +263,12 @@ func loadConfigs() (exp.Config, error) {
 			CachePass: mainflux.Env(envCachePass, defCachePass),
 			CacheURL:  mainflux.Env(envCacheURL, defCacheURL),
 			CacheDB:   mainflux.Env(envCacheDB, defCacheDB),
+			CacheType: mainflux.Env(envCacheType, defCacheType),
+			CacheDir:  mainflux.Env(envCacheDir, defCacheDir),
+
+			ShutdownTimeout: mainflux.Env(envShutdownTimeout, defShutdownTimeout),
+			InstanceID:      mainflux.Env(envInstanceID, defInstanceID),
+			MaxHops:         maxHops,
 		}
 
 		mc := exp.MQTT{
@@ -173,6 +284,24 @@ func loadConfigs() (exp.Config, error) {
 			CAPath:            mainflux.Env(envMqttCA, defMqttCA),
 			ClientCertPath:    mainflux.Env(envMqttCert, defMqttCert),
 			ClientPrivKeyPath: mainflux.Env(envMqttPrivKey, defMqttPrivKey),
+
+			TLSMode:       mainflux.Env(envMqttTLSMode, defMqttTLSMode),
+			ServerName:    mainflux.Env(envMqttServerName, defMqttServerName),
+			MinTLSVersion: mainflux.Env(envMqttMinTLS, defMqttMinTLS),
+
+			ClientP12Path:     mainflux.Env(envMqttP12, defMqttP12),
+			KeyPassphraseFile: mainflux.Env(envMqttPassFile, defMqttPassFile),
+
+			WSPath: mainflux.Env(envMqttWSPath, defMqttWSPath),
+			Proxy:  mainflux.Env(envMqttProxy, defMqttProxy),
+
+			ClientID:          mainflux.Env(envMqttClientID, defMqttClientID),
+			PersistentSession: mqttPersistent,
+			StoreDir:          mainflux.Env(envMqttStoreDir, defMqttStoreDir),
+		}
+		// Passphrase is not saved to the config file, only the name of the variable.
+		if os.Getenv(envMqttPass) != "" {
+			mc.KeyPassphraseEnv = envMqttPass
 		}
 		mqttChannel := mainflux.Env(envMqttChannel, defMqttChannel)
 		mqttTopic := export.Channels + "/" + mqttChannel + "/" + export.Messages
@@ -188,87 +317,55 @@ func loadConfigs() (exp.Config, error) {
 			MQTT:   mc,
 			File:   configFile,
 		}
-		mqtt, err := loadCertificate(cfg.MQTT)
-		cfg.MQTT = mqtt
-		if err != nil {
-			return cfg, err
-		}
-
 		if err := exp.Save(cfg); err != nil {
 			log.Printf("Failed to save %s\n", err)
 		}
 		log.Printf("Configuration loaded from environment, initial %s saved\n", configFile)
 		return cfg, nil
 	}
-	mqtt, err := loadCertificate(cfg.MQTT)
-	if err != nil {
-		return cfg, err
-	}
-	cfg.MQTT = mqtt
 	log.Printf("Configuration loaded from file %s\n", configFile)
 	return cfg, nil
 }
 
-func loadCertificate(cfg exp.MQTT) (exp.MQTT, error) {
-	var caByte []byte
-	var cc []byte
-	var pk []byte
-	if !cfg.MTLS {
-		return cfg, nil
-	}
-
-	caFile, err := os.Open(cfg.CAPath)
-	if err != nil {
-		return cfg, errors.New(err.Error())
-	}
-	defer caFile.Close()
-	caByte, _ = io.ReadAll(caFile)
-
-	if cfg.ClientCertPath != "" {
-		clientCert, err := os.Open(cfg.ClientCertPath)
-		if err != nil {
-			return cfg, errors.New(err.Error())
-		}
-		defer clientCert.Close()
-		cc, err = io.ReadAll(clientCert)
-		if err != nil {
-			return cfg, err
-		}
-	}
-
-	if len(cc) == 0 && cfg.ClientCert != "" {
-		cc = []byte(cfg.ClientCert)
-	}
-
-	if cfg.ClientPrivKeyPath != "" {
-		privKey, err := os.Open(cfg.ClientPrivKeyPath)
-		if err != nil {
-			return cfg, errors.New(err.Error())
+// newCache returns the configured cache and the function that closes
+// its connection once the service is shut down.
+func newCache(cfg exp.Server, logger logger.Logger) (messages.Cache, func() error, error) {
+	noop := func() error { return nil }
+	switch cfg.CacheType {
+	case cacheTypeFile:
+		logger.Info(fmt.Sprintf("Using file cache in %s", cfg.CacheDir))
+		c, err := filecache.NewCache(cfg.CacheDir)
+		return c, noop, err
+	case cacheTypeRedis, "":
+		if cfg.CacheURL == "" {
+			logger.Info("Cache URL not configured, messages that fail to be published will be dropped")
+			return nil, noop, nil
 		}
-		defer privKey.Close()
-		pk, err = io.ReadAll((privKey))
+		client, err := connectToRedis(cfg, logger)
 		if err != nil {
-			return cfg, err
+			return nil, noop, err
 		}
+		return cache.NewCache(client), client.Close, nil
+	default:
+		return nil, noop, fmt.Errorf("unknown cache type %s", cfg.CacheType)
 	}
+}
 
-	if len(pk) == 0 && cfg.ClientCertKey != "" {
-		pk = []byte(cfg.ClientCertKey)
-	}
-
-	if len(pk) == 0 || len(cc) == 0 {
-		return cfg, errors.New("failed loading client certificate")
-	}
-
-	cert, err := tls.X509KeyPair([]byte(cc), []byte(pk))
+func connectToRedis(cfg exp.Server, logger logger.Logger) (*redis.Client, error) {
+	db, err := strconv.Atoi(cfg.CacheDB)
 	if err != nil {
-		return cfg, errors.New(err.Error())
+		return nil, err
 	}
-
-	cfg.TLSCert = cert
-	cfg.CA = caByte
-
-	return cfg, nil
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.CacheURL,
+		Password: cfg.CachePass,
+		DB:       db,
+	})
+	// Client reconnects on its own, so Redis being down at startup is not fatal.
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to connect to Redis %s: %s", cfg.CacheURL, err))
+	}
+	return client, nil
 }
 
 func startHTTPService(svc export.Service, port string, logger logger.Logger, errs chan error) {
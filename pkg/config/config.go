@@ -18,6 +18,28 @@ const (
 	dfltFile = "config.toml"
 )
 
+// Directions of the route. Export routes publish messages from NATS to MQTT,
+// import routes subscribe to MQTT topic filter and publish messages to NATS.
+const (
+	DirectionExport = "export"
+	DirectionImport = "import"
+)
+
+// Hop trail formats of the messages. Properties are MQTT 5 user properties,
+// envelope is JSON object that wraps the payload.
+const (
+	HopTrailProperties = "properties"
+	HopTrailEnvelope   = "envelope"
+	HopTrailOff        = "off"
+)
+
+// TLS modes of the MQTT connection.
+const (
+	TLSOff    = "off"
+	TLSServer = "server"
+	TLSMutual = "mutual"
+)
+
 var (
 	errReadConfigFile         = errors.New("Error reading config file")
 	errWritingConfigFile      = errors.New("Error writing config file")
@@ -39,30 +61,189 @@ type MQTT struct {
 	ClientCertKey     string          `json:"client_cert_key" toml:"client_cert_key" mapstructure:"client_cert_key"`
 	CA                []byte          `json:"-" toml:"-"`
 	TLSCert           tls.Certificate `json:"-" toml:"-"`
+	// Name identifies the broker defined in the brokers section.
+	Name string `json:"name,omitempty" toml:"name,omitempty" mapstructure:"name"`
+	// Hosts are tried after Host when it is unreachable, in order or
+	// round robin depending on HostPolicy. Client moves back to Host
+	// once it is reachable for FailbackAfter.
+	Hosts         []string `json:"hosts,omitempty" toml:"hosts,omitempty" mapstructure:"hosts"`
+	HostPolicy    string   `json:"host_policy,omitempty" toml:"host_policy,omitempty" mapstructure:"host_policy"`
+	FailbackAfter string   `json:"failback_after,omitempty" toml:"failback_after,omitempty" mapstructure:"failback_after"`
+	// ProtocolVersion is 5 for MQTT 5, MQTT 3.1.1 is used otherwise.
+	ProtocolVersion int `json:"protocol_version,omitempty" toml:"protocol_version,omitempty" mapstructure:"protocol_version"`
+	// TLSMode is off, server or mutual. Server verifies the broker using CA,
+	// mutual also presents the client certificate. ServerName overrides the
+	// name used for SNI and verification, MinTLSVersion is 1.0 to 1.3.
+	TLSMode       string `json:"tls_mode,omitempty" toml:"tls_mode,omitempty" mapstructure:"tls_mode"`
+	ServerName    string `json:"server_name,omitempty" toml:"server_name,omitempty" mapstructure:"server_name"`
+	MinTLSVersion string `json:"min_tls_version,omitempty" toml:"min_tls_version,omitempty" mapstructure:"min_tls_version"`
+	// ClientP12Path is PKCS#12 bundle with the client certificate, key and chain,
+	// used instead of PEM files. Passphrase of the bundle or of encrypted PKCS#8
+	// key is read from KeyPassphraseFile or from KeyPassphraseEnv variable.
+	ClientP12Path     string `json:"client_p12_path,omitempty" toml:"client_p12_path,omitempty" mapstructure:"client_p12_path"`
+	KeyPassphraseFile string `json:"key_passphrase_file,omitempty" toml:"key_passphrase_file,omitempty" mapstructure:"key_passphrase_file"`
+	KeyPassphraseEnv  string `json:"key_passphrase_env,omitempty" toml:"key_passphrase_env,omitempty" mapstructure:"key_passphrase_env"`
+	// WSPath and WSHeaders are used by ws:// and wss:// hosts, path is used if host
+	// has none. Proxy is http:// or socks5:// URL connection goes through.
+	WSPath    string            `json:"ws_path,omitempty" toml:"ws_path,omitempty" mapstructure:"ws_path"`
+	WSHeaders map[string]string `json:"ws_headers,omitempty" toml:"ws_headers,omitempty" mapstructure:"ws_headers"`
+	Proxy     string            `json:"proxy,omitempty" toml:"proxy,omitempty" mapstructure:"proxy"`
+	// ClientID defaults to export-<username>. With PersistentSession broker keeps
+	// the session while client is disconnected and unacknowledged messages are
+	// stored in StoreDir, so they are sent again after restart.
+	ClientID          string `json:"client_id,omitempty" toml:"client_id,omitempty" mapstructure:"client_id"`
+	PersistentSession bool   `json:"persistent_session,omitempty" toml:"persistent_session,omitempty" mapstructure:"persistent_session"`
+	StoreDir          string `json:"store_dir,omitempty" toml:"store_dir,omitempty" mapstructure:"store_dir"`
+	// Will is published by the broker once the client connection is lost,
+	// Birth is published by the client on every connect.
+	Will  *Message `json:"will,omitempty" toml:"will,omitempty" mapstructure:"will"`
+	Birth *Message `json:"birth,omitempty" toml:"birth,omitempty" mapstructure:"birth"`
+	// HopTrail is how the IDs of the exporters that published the message are
+	// carried, properties by default.
+	HopTrail string `json:"hop_trail,omitempty" toml:"hop_trail,omitempty" mapstructure:"hop_trail"`
+	// HTTP is set for the HTTP endpoint from the http section,
+	// which is connected to the same way as the brokers.
+	HTTP *HTTP `json:"-" toml:"-" mapstructure:"-"`
+}
+
+// Message is published about the exporter itself. Topic and payload are
+// templates, which can use {{.ClientID}} and {{.Version}} of the exporter.
+type Message struct {
+	Topic   string `json:"topic" toml:"topic" mapstructure:"topic"`
+	Payload string `json:"payload" toml:"payload" mapstructure:"payload"`
+	QoS     int    `json:"qos" toml:"qos" mapstructure:"qos"`
+	Retain  bool   `json:"retain" toml:"retain" mapstructure:"retain"`
+}
+
+// TLS returns the TLS mode of the connection. If mode is not set,
+// MTLS enables mutual TLS.
+func (m MQTT) TLS() string {
+	if m.TLSMode != "" {
+		return m.TLSMode
+	}
+	if m.MTLS {
+		return TLSMutual
+	}
+	return TLSOff
 }
 
 type Server struct {
 	BrokerURL string `json:"broker_url" toml:"broker_url" mapstructure:"broker_url"`
 	LogLevel  string `json:"log_level" toml:"log_level" mapstructure:"log_level"`
 	Port      string `json:"port" toml:"port" mapstructure:"port"`
-	CacheURL  string `json:"cache_url" toml:"cache_url" mapstructure:"port"`
-	CachePass string `json:"cache_pass" toml:"cache_pass" mapstructure:"port"`
-	CacheDB   string `json:"cache_db" toml:"cache_db" mapstructure:"port"`
+	CacheURL  string `json:"cache_url" toml:"cache_url" mapstructure:"cache_url"`
+	CachePass string `json:"cache_pass" toml:"cache_pass" mapstructure:"cache_pass"`
+	CacheDB   string `json:"cache_db" toml:"cache_db" mapstructure:"cache_db"`
+	CacheType string `json:"cache_type" toml:"cache_type" mapstructure:"cache_type"`
+	CacheDir  string `json:"cache_dir" toml:"cache_dir" mapstructure:"cache_dir"`
+	// Time to wait for messages in progress to be published on shutdown.
+	ShutdownTimeout string `json:"shutdown_timeout" toml:"shutdown_timeout" mapstructure:"shutdown_timeout"`
+	// InstanceID identifies the exporter in hop trails, it defaults to host name.
+	// Messages that passed through MaxHops exporters are not published, 0 means no limit.
+	InstanceID string `json:"instance_id,omitempty" toml:"instance_id,omitempty" mapstructure:"instance_id"`
+	MaxHops    int    `json:"max_hops,omitempty" toml:"max_hops,omitempty" mapstructure:"max_hops"`
 }
 
 type Config struct {
 	Server Server  `json:"exp" toml:"exp" mapstructure:"exp"`
 	Routes []Route `json:"routes" toml:"routes" mapstructure:"routes"`
 	MQTT   MQTT    `json:"mqtt" toml:"mqtt" mapstructure:"mqtt"`
-	File   string  `json:"file"`
+	// Brokers that routes can publish to instead of the one from MQTT section.
+	Brokers []MQTT `json:"brokers,omitempty" toml:"brokers,omitempty" mapstructure:"brokers"`
+	// NATS servers that nats routes bridge messages to.
+	NATS []NATS `json:"nats,omitempty" toml:"nats,omitempty" mapstructure:"nats"`
+	// HTTP endpoints that routes send messages to instead of MQTT broker.
+	HTTP []HTTP `json:"http,omitempty" toml:"http,omitempty" mapstructure:"http"`
+	// DeadLetter configures where messages that routes fail to process are sent.
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty" toml:"dead_letter,omitempty" mapstructure:"dead_letter"`
+	File       string      `json:"file"`
+}
+
+// NATS is the NATS server nats routes publish to, i.e. the regional NATS
+// of the gateways. URL has the format of BrokerURL and can list several
+// servers separated by commas. With Flush, routes wait for the server to
+// receive every message.
+type NATS struct {
+	Name     string `json:"name" toml:"name" mapstructure:"name"`
+	URL      string `json:"url" toml:"url" mapstructure:"url"`
+	Username string `json:"username,omitempty" toml:"username,omitempty" mapstructure:"username"`
+	Password string `json:"password,omitempty" toml:"password,omitempty" mapstructure:"password"`
+	Flush    bool   `json:"flush,omitempty" toml:"flush,omitempty" mapstructure:"flush"`
+	// TLS options are the same as the ones of MQTT brokers.
+	TLSMode           string `json:"tls_mode,omitempty" toml:"tls_mode,omitempty" mapstructure:"tls_mode"`
+	SkipTLSVer        bool   `json:"skip_tls_ver,omitempty" toml:"skip_tls_ver,omitempty" mapstructure:"skip_tls_ver"`
+	ServerName        string `json:"server_name,omitempty" toml:"server_name,omitempty" mapstructure:"server_name"`
+	CAPath            string `json:"ca_path,omitempty" toml:"ca_path,omitempty" mapstructure:"ca_path"`
+	ClientCertPath    string `json:"client_cert_path,omitempty" toml:"client_cert_path,omitempty" mapstructure:"client_cert_path"`
+	ClientPrivKeyPath string `json:"client_priv_key_path,omitempty" toml:"client_priv_key_path,omitempty" mapstructure:"client_priv_key_path"`
+}
+
+// HTTP is the endpoint messages are sent to in batches of up to BatchSize,
+// waiting at most BatchInterval for the batch to fill. Requests that fail
+// are retried Retries times with backoff. BearerToken is used instead of
+// basic authentication if it is set.
+type HTTP struct {
+	Name          string            `json:"name" toml:"name" mapstructure:"name"`
+	URL           string            `json:"url" toml:"url" mapstructure:"url"`
+	Method        string            `json:"method,omitempty" toml:"method,omitempty" mapstructure:"method"`
+	Headers       map[string]string `json:"headers,omitempty" toml:"headers,omitempty" mapstructure:"headers"`
+	Username      string            `json:"username,omitempty" toml:"username,omitempty" mapstructure:"username"`
+	Password      string            `json:"password,omitempty" toml:"password,omitempty" mapstructure:"password"`
+	BearerToken   string            `json:"bearer_token,omitempty" toml:"bearer_token,omitempty" mapstructure:"bearer_token"`
+	BatchSize     int               `json:"batch_size,omitempty" toml:"batch_size,omitempty" mapstructure:"batch_size"`
+	BatchInterval string            `json:"batch_interval,omitempty" toml:"batch_interval,omitempty" mapstructure:"batch_interval"`
+	Retries       int               `json:"retries,omitempty" toml:"retries,omitempty" mapstructure:"retries"`
+	Proxy         string            `json:"proxy,omitempty" toml:"proxy,omitempty" mapstructure:"proxy"`
+	// TLS options are the same as the ones of MQTT brokers.
+	TLSMode           string `json:"tls_mode,omitempty" toml:"tls_mode,omitempty" mapstructure:"tls_mode"`
+	SkipTLSVer        bool   `json:"skip_tls_ver,omitempty" toml:"skip_tls_ver,omitempty" mapstructure:"skip_tls_ver"`
+	ServerName        string `json:"server_name,omitempty" toml:"server_name,omitempty" mapstructure:"server_name"`
+	CAPath            string `json:"ca_path,omitempty" toml:"ca_path,omitempty" mapstructure:"ca_path"`
+	ClientCertPath    string `json:"client_cert_path,omitempty" toml:"client_cert_path,omitempty" mapstructure:"client_cert_path"`
+	ClientPrivKeyPath string `json:"client_priv_key_path,omitempty" toml:"client_priv_key_path,omitempty" mapstructure:"client_priv_key_path"`
+}
+
+// DeadLetter contains NATS subject and MQTT topic of the route broker that
+// dead letters are published to, besides being stored in the cache.
+type DeadLetter struct {
+	NatsSubject string `json:"nats_subject,omitempty" toml:"nats_subject,omitempty" mapstructure:"nats_subject"`
+	MqttTopic   string `json:"mqtt_topic,omitempty" toml:"mqtt_topic,omitempty" mapstructure:"mqtt_topic"`
+	// Retention of the stored dead letters, the same as of the route buffer.
+	MaxBufferSize int64  `json:"max_buffer_size,omitempty" toml:"max_buffer_size,omitempty" mapstructure:"max_buffer_size"`
+	MaxBufferAge  string `json:"max_buffer_age,omitempty" toml:"max_buffer_age,omitempty" mapstructure:"max_buffer_age"`
+	Overflow      string `json:"overflow,omitempty" toml:"overflow,omitempty" mapstructure:"overflow"`
 }
 
 type Route struct {
+	// Name identifies the route, it defaults to NATS topic.
+	Name      string `json:"name,omitempty" toml:"name,omitempty" mapstructure:"name"`
 	MqttTopic string `json:"mqtt_topic" toml:"mqtt_topic" mapstructure:"mqtt_topic"`
 	NatsTopic string `json:"nats_topic" toml:"nats_topic" mapstructure:"nats_topic"`
 	SubTopic  string `json:"subtopic" toml:"subtopic" mapstructure:"subtopic"`
 	Type      string `json:"type" toml:"type" mapstructure:"type"`
-	Workers   int    `json:"workers" toml:"workers" mapstructure:"workers"`
+	// Broker is the name of the broker messages are published to.
+	// Broker from the MQTT section is used if not set.
+	Broker  string `json:"broker,omitempty" toml:"broker,omitempty" mapstructure:"broker"`
+	Workers int    `json:"workers" toml:"workers" mapstructure:"workers"`
+	// Target is the name of the HTTP endpoint or NATS server the route
+	// publishes to instead of the broker. Nats routes publish to NatsSubject
+	// with channel and subtopic of the message appended.
+	Target      string `json:"target,omitempty" toml:"target,omitempty" mapstructure:"target"`
+	NatsSubject string `json:"nats_subject,omitempty" toml:"nats_subject,omitempty" mapstructure:"nats_subject"`
+	// QoS and Retain override the MQTT settings when set.
+	QoS    *int  `json:"qos,omitempty" toml:"qos,omitempty" mapstructure:"qos"`
+	Retain *bool `json:"retain,omitempty" toml:"retain,omitempty" mapstructure:"retain"`
+	// Retention of the messages buffered while MQTT broker is unreachable.
+	MaxBufferSize int64  `json:"max_buffer_size" toml:"max_buffer_size" mapstructure:"max_buffer_size"`
+	MaxBufferAge  string `json:"max_buffer_age" toml:"max_buffer_age" mapstructure:"max_buffer_age"`
+	Overflow      string `json:"overflow" toml:"overflow" mapstructure:"overflow"`
+	// ContentType and TTL set content type and message expiry of MQTT 5 messages.
+	ContentType string `json:"content_type,omitempty" toml:"content_type,omitempty" mapstructure:"content_type"`
+	TTL         string `json:"ttl,omitempty" toml:"ttl,omitempty" mapstructure:"ttl"`
+	// Direction is export, unless set to import. MqttTopic of import route
+	// is topic filter and NatsTopic is the channel of messages whose topic
+	// is not channels/<channel_id>/messages.
+	Direction string `json:"direction,omitempty" toml:"direction,omitempty" mapstructure:"direction"`
 }
 
 // Save - store config in a file.
@@ -0,0 +1,56 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors usually save the file in several steps,
+// so changes are reported once the file settles.
+const settleDelay = time.Second
+
+// Watch calls onChange every time the file changes, until ctx is done.
+// Directory of the file is watched, so the file can be replaced or
+// created after the watch started.
+func Watch(ctx context.Context, file string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	file = filepath.Clean(file)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(settleDelay)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) != file || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			timer.Reset(settleDelay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-timer.C:
+			onChange()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
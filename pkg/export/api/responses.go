@@ -0,0 +1,25 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/export"
+)
+
+type routesRes struct {
+	Routes []config.Route `json:"routes"`
+}
+
+type deadLettersRes struct {
+	DeadLetters []export.DeadLetter `json:"dead_letters"`
+}
+
+type purgeRes struct {
+	Purged int `json:"purged"`
+}
+
+type errorRes struct {
+	Err string `json:"error"`
+}
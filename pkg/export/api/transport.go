@@ -7,18 +7,208 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/go-zoo/bone"
+	"github.com/mainflux/export/pkg/config"
 	"github.com/mainflux/export/pkg/export"
 	"github.com/mainflux/mainflux"
+	"github.com/mainflux/mainflux/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	contentType = "application/json"
+
+	// Number of dead letters listed unless limit is given.
+	defLimit = 100
+)
+
+var errMalformedEntity = errors.New("malformed entity")
+
 // MakeHandler returns a HTTP API handler with version and metrics.
 func MakeHandler(svc export.Service) http.Handler {
 	r := bone.New()
 	r.Handle("/metrics", promhttp.Handler())
 	r.GetFunc("/health", mainflux.Health("export", ""))
+	r.GetFunc("/version", mainflux.Health("export", ""))
+	r.GetFunc("/status", status(svc))
+	r.GetFunc("/ready", ready(svc))
+	r.GetFunc("/routes", listRoutes(svc))
+	r.PostFunc("/routes", createRoute(svc))
+	r.GetFunc("/routes/:name", viewRoute(svc))
+	r.PutFunc("/routes/:name", updateRoute(svc))
+	r.DeleteFunc("/routes/:name", removeRoute(svc))
+	r.GetFunc("/deadletters", listDeadLetters(svc))
+	r.PostFunc("/deadletters/retry", retryDeadLetters(svc))
+	r.PostFunc("/deadletters/:id/retry", retryDeadLetters(svc))
+	r.DeleteFunc("/deadletters", purgeDeadLetters(svc))
+	r.DeleteFunc("/deadletters/:id", purgeDeadLetters(svc))
 	return r
 }
+
+func status(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(w, http.StatusOK, svc.Status())
+	}
+}
+
+// ready responds with the service status and code 503 until
+// messages can flow from the message bus to MQTT broker.
+func ready(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := svc.Status()
+		code := http.StatusOK
+		if !s.Ready() {
+			code = http.StatusServiceUnavailable
+		}
+		encodeResponse(w, code, s)
+	}
+}
+
+func listRoutes(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(w, http.StatusOK, routesRes{Routes: svc.ListRoutes()})
+	}
+}
+
+func viewRoute(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := svc.ViewRoute(bone.GetValue(r, "name"))
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, route)
+	}
+}
+
+func createRoute(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := decodeRoute(r)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		if err := svc.CreateRoute(route); err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusCreated, route)
+	}
+}
+
+func updateRoute(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := decodeRoute(r)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		name := bone.GetValue(r, "name")
+		if route.Name == "" {
+			route.Name = name
+		}
+		if err := svc.UpdateRoute(name, route); err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, route)
+	}
+}
+
+func removeRoute(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := svc.RemoveRoute(bone.GetValue(r, "name")); err != nil {
+			encodeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listDeadLetters(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(defLimit)
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.ParseInt(l, 10, 64)
+			if err != nil || n < 1 {
+				encodeError(w, errors.Wrap(errMalformedEntity, errors.New("limit")))
+				return
+			}
+			limit = n
+		}
+		dls, err := svc.ListDeadLetters(limit)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, deadLettersRes{DeadLetters: dls})
+	}
+}
+
+// retryDeadLetters retries the dead letter with ID from the path, or all of them.
+func retryDeadLetters(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := svc.RetryDeadLetters(deadLetterIDs(r)...)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, res)
+	}
+}
+
+// purgeDeadLetters removes the dead letter with ID from the path, or all of them.
+func purgeDeadLetters(svc export.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := svc.PurgeDeadLetters(deadLetterIDs(r)...)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, purgeRes{Purged: n})
+	}
+}
+
+func deadLetterIDs(r *http.Request) []string {
+	if id := bone.GetValue(r, "id"); id != "" {
+		return []string{id}
+	}
+	return nil
+}
+
+func decodeRoute(r *http.Request) (config.Route, error) {
+	var route config.Route
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&route); err != nil {
+		return route, errors.Wrap(errMalformedEntity, err)
+	}
+	return route, nil
+}
+
+func encodeResponse(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func encodeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Contains(err, errMalformedEntity),
+		errors.Contains(err, export.ErrInvalidConfig):
+		code = http.StatusBadRequest
+	case errors.Contains(err, export.ErrNotFound),
+		errors.Contains(err, export.ErrDeadLetterNotFound):
+		code = http.StatusNotFound
+	case errors.Contains(err, export.ErrConflict):
+		code = http.StatusConflict
+	}
+	encodeResponse(w, code, errorRes{Err: err.Error()})
+}
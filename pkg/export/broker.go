@@ -0,0 +1,891 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux"
+	logger "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Routes without broker publish to the broker from the [mqtt] section.
+	defaultBroker = "default"
+
+	// Host policies. Failover always tries hosts in the configured order,
+	// while round robin starts from the host after the last one used.
+	failover   = "failover"
+	roundRobin = "round_robin"
+
+	probeTimeout = 5 * time.Second
+
+	// MQTT protocol versions. Versions other than MQTT 5 use MQTT 3.1.1
+	// client, which falls back to MQTT 3.1 unless the version is set.
+	mqtt311 = 4
+	mqtt5   = 5
+)
+
+var (
+	errBadBroker       = errors.New("Bad broker")
+	errDuplicateBroker = errors.New("Duplicate broker name")
+	errUnknownBroker   = errors.New("Unknown broker")
+	errBadMessage      = errors.New("Bad will or birth message")
+	errStoreDir        = errors.New("store dir is supported only with persistent session over MQTT 3.1.1")
+	errHopTrail        = errors.New("hop trail properties are supported only over MQTT 5")
+	errMQTTOption      = errors.New("option is supported only by MQTT brokers")
+)
+
+// mqttClient is the connection to the broker over MQTT 3.1.1 or MQTT 5.
+// Once connected, client reconnects on its own and reports the state
+// of the connection to the broker handlers.
+type mqttClient interface {
+	// Connect makes a single attempt to connect to each of the hosts.
+	Connect() error
+	Publish(topic string, payload []byte, qos byte, retain bool, o messages.Options) error
+	// Subscribe subscribes to the topic filter. Messages are
+	// passed to the broker received handler.
+	Subscribe(filter string, qos byte) error
+	Unsubscribe(filter string) error
+	IsConnectionOpen() bool
+	Disconnect()
+}
+
+// queueClient is implemented by the clients that queue the messages and
+// send them in the background, such as the HTTP client sending batches.
+type queueClient interface {
+	// Enqueue returns once the message is queued and done is called with
+	// the result of sending it. Done is not called if Enqueue fails.
+	Enqueue(topic string, payload []byte, o messages.Options, done func(error)) error
+	// Flush sends the queued messages without waiting for the batches to fill.
+	Flush()
+	// Drain sends the queued messages and waits until they are sent.
+	Drain(ctx context.Context)
+}
+
+// broker is the connection to the upstream MQTT broker.
+// Broker is replaced rather than changed when its configuration changes.
+type broker struct {
+	name          string
+	cfg           config.MQTT
+	hosts         []string
+	policy        string
+	failbackAfter time.Duration
+	client        mqttClient
+	certs         *certs
+	conn          connection
+	// Will and birth messages, nil unless configured.
+	will  *statusMessage
+	birth *statusMessage
+	// Host of the last connection attempt and the host client is connected to.
+	attempt string
+	active  string
+	mu      sync.Mutex
+	// Closed to stop the initial connection attempts, which
+	// are tracked by starting, so close can wait for them.
+	stop      chan struct{}
+	starting  sync.WaitGroup
+	done      <-chan struct{}
+	onConnect func()
+	logger    logger.Logger
+	// imports returns QoS by topic filter of the import routes,
+	// onMessage passes the messages received to them.
+	imports   func() map[string]byte
+	onMessage func(topic string, payload []byte, props map[string]string)
+}
+
+func (e *exporter) newBroker(name string, cfg config.MQTT) *broker {
+	b := &broker{
+		name:      name,
+		cfg:       cfg,
+		conn:      connection{name: "mqtt/" + name},
+		stop:      make(chan struct{}),
+		done:      e.done,
+		onConnect: e.triggerReplay,
+		logger:    e.logger,
+		hosts:     hosts(cfg),
+		policy:    cfg.HostPolicy,
+	}
+	if b.policy == "" {
+		b.policy = failover
+	}
+	b.imports = func() map[string]byte {
+		return e.imports(name)
+	}
+	b.onMessage = func(topic string, payload []byte, props map[string]string) {
+		e.received(b, topic, payload, props)
+	}
+	// Configuration is validated by brokerConfigs.
+	b.failbackAfter, _ = time.ParseDuration(cfg.FailbackAfter)
+	// Messages are validated by brokerConfigs.
+	b.will, _ = b.statusMessage(cfg.Will)
+	b.birth, _ = b.statusMessage(cfg.Birth)
+	if b.certs, _ = newCerts(cfg); b.certs == nil {
+		// Certificates were removed since validation, they are loaded once they are back.
+		b.certs = &certs{cfg: cfg}
+	}
+	switch {
+	case isNATS(cfg):
+		b.conn.name = "nats/" + name
+		b.client = newNATSClient(b)
+	case isHTTP(cfg):
+		b.conn.name = "http/" + name
+		b.client = newHTTPClient(b)
+	case cfg.ProtocolVersion == mqtt5:
+		b.client = newMQTT5Client(b)
+	default:
+		b.client = newMQTT3Client(b)
+	}
+	return b
+}
+
+// hosts returns the broker hosts, starting with the preferred one.
+// Hosts are normalized the same way MQTT client does it, so they
+// match the hosts client connects to.
+func hosts(cfg config.MQTT) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, h := range append([]string{cfg.Host}, cfg.Hosts...) {
+		if h == "" {
+			continue
+		}
+		if strings.HasPrefix(h, ":") {
+			h = "127.0.0.1" + h
+		}
+		if !strings.Contains(h, "://") {
+			h = "tcp://" + h
+		}
+		if u, err := url.Parse(h); err == nil {
+			h = u.String()
+		}
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+func validateBroker(cfg config.MQTT) error {
+	hs := hosts(cfg)
+	if len(hs) == 0 {
+		return errors.New("no hosts")
+	}
+	for _, h := range hs {
+		u, err := url.Parse(h)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss", "unix", natsScheme, "http", "https":
+		default:
+			return errors.Wrap(errUnsupportedScheme, errors.New(u.Scheme))
+		}
+		if (u.Scheme == natsScheme) != isNATS(cfg) {
+			return errNATSHosts
+		}
+		if isHTTPScheme(u.Scheme) != isHTTP(cfg) {
+			return errHTTPHosts
+		}
+	}
+	if err := validateProxy(cfg.Proxy); err != nil {
+		return err
+	}
+	switch cfg.HostPolicy {
+	case "", failover, roundRobin:
+	default:
+		return fmt.Errorf("unknown host policy %s", cfg.HostPolicy)
+	}
+	if cfg.FailbackAfter != "" {
+		if _, err := time.ParseDuration(cfg.FailbackAfter); err != nil {
+			return err
+		}
+	}
+	switch cfg.ProtocolVersion {
+	case 0, 3, mqtt311, mqtt5:
+	default:
+		return fmt.Errorf("unsupported protocol version %d", cfg.ProtocolVersion)
+	}
+	switch cfg.TLS() {
+	case config.TLSOff, config.TLSServer, config.TLSMutual:
+	default:
+		return fmt.Errorf("unknown TLS mode %s", cfg.TLSMode)
+	}
+	if _, err := tlsVersion(cfg.MinTLSVersion); err != nil {
+		return err
+	}
+	if _, err := newCerts(cfg); err != nil {
+		return err
+	}
+	if cfg.StoreDir != "" && (!cfg.PersistentSession || cfg.ProtocolVersion == mqtt5) {
+		return errStoreDir
+	}
+	switch cfg.HopTrail {
+	case "", config.HopTrailEnvelope, config.HopTrailOff:
+	case config.HopTrailProperties:
+		if cfg.ProtocolVersion != mqtt5 {
+			return errHopTrail
+		}
+	default:
+		return fmt.Errorf("unknown hop trail %s", cfg.HopTrail)
+	}
+	b := &broker{cfg: cfg}
+	for _, m := range []*config.Message{cfg.Will, cfg.Birth} {
+		if _, err := b.statusMessage(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// option is the broker option, which is rejected
+// if it is set for the broker that doesn't support it.
+type option struct {
+	name string
+	set  bool
+}
+
+// rejectOptions returns err with the name of the first option that is set.
+func rejectOptions(err error, opts ...option) error {
+	for _, o := range opts {
+		if o.set {
+			return errors.Wrap(err, errors.New(o.name))
+		}
+	}
+	return nil
+}
+
+// statusMessage is the will or birth message with the templates executed.
+type statusMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// statusMessage executes the templates of the message.
+func (b *broker) statusMessage(m *config.Message) (*statusMessage, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.QoS < 0 || m.QoS > 2 {
+		return nil, errors.Wrap(errBadMessage, fmt.Errorf("QoS %d", m.QoS))
+	}
+	data := struct {
+		ClientID string
+		Version  string
+	}{b.clientID(), mainflux.Version}
+	topic, err := execute(m.Topic, data)
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, err)
+	}
+	if topic == "" {
+		return nil, errors.Wrap(errBadMessage, errors.New("empty topic"))
+	}
+	payload, err := execute(m.Payload, data)
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, err)
+	}
+	return &statusMessage{
+		topic:   topic,
+		payload: []byte(payload),
+		qos:     byte(m.QoS),
+		retain:  m.Retain,
+	}, nil
+}
+
+func execute(text string, data interface{}) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// tlsVersion parses the TLS version, 0 means the default minimum version.
+func tlsVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %s", v)
+	}
+}
+
+// brokerConfigs returns MQTT configurations by broker name. Broker from the
+// [mqtt] section is included if its host is set. NATS servers and HTTP
+// endpoints are included as brokers too, so they share the names with them.
+func brokerConfigs(c config.Config) (map[string]config.MQTT, error) {
+	brokers := make(map[string]config.MQTT)
+	if len(hosts(c.MQTT)) > 0 {
+		if err := validateMQTT(c.MQTT); err != nil {
+			return nil, errors.Wrap(errBadBroker, errors.Wrap(errors.New(defaultBroker), err))
+		}
+		brokers[defaultBroker] = c.MQTT
+	}
+	for _, b := range c.Brokers {
+		if b.Name == "" || b.Name == defaultBroker {
+			return nil, errors.Wrap(errBadBroker, errors.New(b.Name))
+		}
+		if err := validateMQTT(b); err != nil {
+			return nil, errors.Wrap(errBadBroker, errors.Wrap(errors.New(b.Name), err))
+		}
+		if _, ok := brokers[b.Name]; ok {
+			return nil, errors.Wrap(errDuplicateBroker, errors.New(b.Name))
+		}
+		brokers[b.Name] = b
+	}
+	for _, n := range c.NATS {
+		if n.Name == "" || n.Name == defaultBroker {
+			return nil, errors.Wrap(errBadTarget, errors.New(n.Name))
+		}
+		cfg, err := natsBroker(n)
+		if err == nil {
+			err = validateBroker(cfg)
+		}
+		if err != nil {
+			return nil, errors.Wrap(errBadTarget, errors.Wrap(errors.New(n.Name), err))
+		}
+		if _, ok := brokers[n.Name]; ok {
+			return nil, errors.Wrap(errDuplicateBroker, errors.New(n.Name))
+		}
+		brokers[n.Name] = cfg
+	}
+	for _, h := range c.HTTP {
+		if h.Name == "" || h.Name == defaultBroker {
+			return nil, errors.Wrap(errBadEndpoint, errors.New(h.Name))
+		}
+		cfg, err := httpBroker(h)
+		if err == nil {
+			err = validateBroker(cfg)
+		}
+		if err != nil {
+			return nil, errors.Wrap(errBadEndpoint, errors.Wrap(errors.New(h.Name), err))
+		}
+		if _, ok := brokers[h.Name]; ok {
+			return nil, errors.Wrap(errDuplicateBroker, errors.New(h.Name))
+		}
+		brokers[h.Name] = cfg
+	}
+	return brokers, nil
+}
+
+// validateMQTT validates the broker from the [mqtt] or brokers section.
+func validateMQTT(cfg config.MQTT) error {
+	if isNATS(cfg) {
+		return errNATSHosts
+	}
+	return validateBroker(cfg)
+}
+
+// brokerName returns the name of the broker the route publishes to.
+func brokerName(rc config.Route) string {
+	switch {
+	case rc.Target != "":
+		return rc.Target
+	case rc.Broker != "":
+		return rc.Broker
+	}
+	return defaultBroker
+}
+
+// updateBrokers connects to the new brokers and reconnects to the changed
+// ones, closing the old connection first, so both are never open at once.
+// Brokers that are no longer configured are returned, so they can be
+// disconnected once the routes are updated.
+func (e *exporter) updateBrokers(cfgs map[string]config.MQTT) []*broker {
+	e.Lock()
+	var stale []*broker
+	var started []*broker
+	replaced := make(map[*broker]*broker)
+	for name, b := range e.brokers {
+		cfg, ok := cfgs[name]
+		switch {
+		case !ok:
+			e.logger.Info(fmt.Sprintf("Removing broker %s", name))
+			delete(e.brokers, name)
+			stale = append(stale, b)
+		case !reflect.DeepEqual(b.cfg, cfg):
+			e.logger.Info(fmt.Sprintf("Configuration of broker %s changed, reconnecting", name))
+			nb := e.newBroker(name, cfg)
+			e.brokers[name] = nb
+			started = append(started, nb)
+			replaced[b] = nb
+		}
+	}
+	for name, cfg := range cfgs {
+		if _, ok := e.brokers[name]; ok {
+			continue
+		}
+		e.logger.Info(fmt.Sprintf("Adding broker %s", name))
+		b := e.newBroker(name, cfg)
+		e.brokers[name] = b
+		started = append(started, b)
+	}
+	e.Unlock()
+	// Meanwhile, routes store messages, since the new brokers are not connected yet.
+	for b, nb := range replaced {
+		b.close()
+		b.replaceWith(nb)
+	}
+	for _, b := range started {
+		b.start()
+		go b.watchCerts()
+	}
+	return stale
+}
+
+// broker returns the broker the stream messages are published to.
+func (e *exporter) broker(stream string) (*broker, error) {
+	e.RLock()
+	defer e.RUnlock()
+	b, ok := e.brokers[e.streams[stream]]
+	if !ok {
+		return nil, errUnknownBroker
+	}
+	return b, nil
+}
+
+func (e *exporter) brokerStatus() []BrokerStatus {
+	e.RLock()
+	brokers := make([]BrokerStatus, 0, len(e.brokers))
+	for _, b := range e.brokers {
+		brokers = append(brokers, BrokerStatus{
+			Name:             b.name,
+			Host:             b.hosts[0],
+			Active:           b.activeHost(),
+			ConnectionStatus: b.conn.get(),
+		})
+	}
+	e.RUnlock()
+	sort.Slice(brokers, func(i, j int) bool {
+		return brokers[i].Name < brokers[j].Name
+	})
+	return brokers
+}
+
+// publish publishes the message using the broker QoS and retain
+// settings, unless options override them.
+func (b *broker) publish(topic string, payload []byte, o messages.Options) error {
+	qos, retain := byte(b.cfg.QoS), b.cfg.Retain
+	if o.QoS != nil {
+		qos = *o.QoS
+	}
+	if o.Retain != nil {
+		retain = *o.Retain
+	}
+	if !b.client.IsConnectionOpen() {
+		return errNotConnected
+	}
+	if err := b.client.Publish(topic, payload, qos, retain, o); err != nil {
+		b.logger.Error(fmt.Sprintf("Failed to publish to topic %s on broker %s", topic, b.name))
+		return err
+	}
+	return nil
+}
+
+// Connection handlers are called by the client.
+
+func (b *broker) connected() {
+	b.mu.Lock()
+	b.active = b.attempt
+	active := b.active
+	b.mu.Unlock()
+	b.logger.Debug(fmt.Sprintf("Client %s connected to broker %s at %s", b.clientID(), b.name, active))
+	b.reportHost(active)
+	if active != b.hosts[0] {
+		failovers.WithLabelValues(b.name).Inc()
+		if b.policy == failover && b.failbackAfter > 0 {
+			go b.failback(active)
+		}
+	}
+	b.conn.set(StateConnected)
+	// Session may not be kept by the broker, so import routes subscribe on every connect.
+	for filter, qos := range b.imports() {
+		b.subscribe(filter, qos)
+	}
+	// Birth message goes out before the replay of stored messages.
+	if m := b.birth; m != nil {
+		if err := b.client.Publish(m.topic, m.payload, m.qos, m.retain, messages.Options{}); err != nil {
+			b.logger.Warn(fmt.Sprintf("Failed to publish birth message to broker %s: %s", b.name, err))
+		}
+	}
+	b.onConnect()
+}
+
+func (b *broker) lost(err error) {
+	b.logger.Debug(fmt.Sprintf("Client %s disconnected from broker %s", b.clientID(), b.name))
+	b.mu.Lock()
+	b.active = ""
+	b.mu.Unlock()
+	b.reportHost("")
+	b.conn.failed(StateDisconnected, err)
+}
+
+func (b *broker) reconnecting() {
+	b.conn.set(StateReconnecting)
+}
+
+// connecting records the host of the connection attempt.
+func (b *broker) connecting(host string) {
+	b.mu.Lock()
+	b.attempt = host
+	b.mu.Unlock()
+}
+
+// order returns the hosts in order they are tried when reconnecting.
+// With round robin policy, hosts start from the one after the host used last.
+func (b *broker) order(hosts []*url.URL) []*url.URL {
+	if b.policy != roundRobin || len(hosts) < 2 {
+		return hosts
+	}
+	b.mu.Lock()
+	last := b.attempt
+	b.mu.Unlock()
+	for i, h := range hosts {
+		if h.String() == last {
+			i = (i + 1) % len(hosts)
+			return append(append([]*url.URL{}, hosts[i:]...), hosts[:i]...)
+		}
+	}
+	return hosts
+}
+
+func (b *broker) activeHost() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// reportHost updates the active host metric.
+func (b *broker) reportHost(active string) {
+	for _, h := range b.hosts {
+		v := 0.0
+		if h == active {
+			v = 1
+		}
+		activeHost.WithLabelValues(b.name, h).Set(v)
+	}
+}
+
+// failback reconnects the client to the preferred host once it is reachable,
+// checking every failbackAfter as long as the client stays connected to host.
+func (b *broker) failback(host string) {
+	ticker := time.NewTicker(b.failbackAfter)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		case <-b.done:
+			return
+		}
+		if !b.client.IsConnectionOpen() || b.activeHost() != host {
+			return
+		}
+		if err := b.probe(b.hosts[0]); err != nil {
+			b.logger.Debug(fmt.Sprintf("Preferred host %s of broker %s is still unreachable: %s", b.hosts[0], b.name, err))
+			continue
+		}
+		b.logger.Info(fmt.Sprintf("Preferred host %s of broker %s is reachable, reconnecting", b.hosts[0], b.name))
+		b.reconnect()
+		return
+	}
+}
+
+// reconnect disconnects the client and connects it again.
+func (b *broker) reconnect() {
+	b.client.Disconnect()
+	b.mu.Lock()
+	b.active = ""
+	b.mu.Unlock()
+	b.conn.set(StateDisconnected)
+	b.start()
+}
+
+// watchCerts reloads the certificates when their files change, reconnecting
+// the client with the new ones, and warns when the client certificate expires soon.
+func (b *broker) watchCerts() {
+	files := b.certs.files()
+	if len(files) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 1)
+	for _, f := range files {
+		go func(f string) {
+			err := config.Watch(ctx, f, func() {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				b.logger.Error(fmt.Sprintf("Stopped watching certificate %s of broker %s: %s", f, b.name, err))
+			}
+		}(f)
+	}
+
+	b.checkExpiry()
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changes:
+			changed, err := b.certs.load()
+			if err != nil {
+				b.logger.Error(fmt.Sprintf("Failed to reload certificates of broker %s, keeping the current ones: %s", b.name, err))
+				continue
+			}
+			if !changed {
+				continue
+			}
+			b.logger.Info(fmt.Sprintf("Certificates of broker %s changed", b.name))
+			b.checkExpiry()
+			if b.client.IsConnectionOpen() {
+				b.reconnect()
+			}
+		case <-ticker.C:
+			b.checkExpiry()
+		case <-b.stop:
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// checkExpiry reports the expiry of the client certificate.
+func (b *broker) checkExpiry() {
+	notAfter := b.certs.expiry()
+	if notAfter.IsZero() {
+		return
+	}
+	certificateExpiry.WithLabelValues(b.name).Set(float64(notAfter.Unix()))
+	switch left := time.Until(notAfter); {
+	case left <= 0:
+		b.logger.Error(fmt.Sprintf("Client certificate of broker %s expired at %s", b.name, notAfter.Format(time.RFC3339)))
+	case left <= certExpiryWarning:
+		b.logger.Warn(fmt.Sprintf("Client certificate of broker %s expires at %s", b.name, notAfter.Format(time.RFC3339)))
+	}
+}
+
+// probe checks if TCP connection to the host can be established.
+func (b *broker) probe(host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	conn, err := b.dial(address(u), probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// address returns the host and port of the broker URL,
+// using the default port of the scheme if port is not set.
+func address(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		port = "8883"
+	case "ws":
+		port = "80"
+	case "wss", "https":
+		port = "443"
+	case "http":
+		port = "80"
+	case natsScheme:
+		port = "4222"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// start connects the client in the background, unless the broker is closed.
+func (b *broker) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.stop:
+		return
+	default:
+	}
+	b.starting.Add(1)
+	go func() {
+		defer b.starting.Done()
+		b.connect()
+	}()
+}
+
+// connect retries the initial connection with backoff until it succeeds
+// or the broker is closed. Once connected, client reconnects on its own.
+func (b *broker) connect() {
+	for attempt := 1; ; attempt++ {
+		b.conn.set(StateConnecting)
+		err := b.client.Connect()
+		if err == nil {
+			select {
+			case <-b.stop:
+				// Broker was closed while connecting.
+				b.client.Disconnect()
+			default:
+			}
+			return
+		}
+		d := backoff(attempt)
+		b.logger.Error(fmt.Sprintf("Client %s had error connecting to the broker %s: %v, retrying in %s", b.clientID(), b.name, err, d))
+		b.conn.failed(StateConnecting, err)
+		select {
+		case <-time.After(d):
+		case <-b.stop:
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// close stops the connection attempts, disconnects the client and waits
+// for the attempt in progress, which disconnects the client if it succeeds.
+// Broker no longer reports its state, since the broker replacing it reports
+// the same metrics.
+func (b *broker) close() {
+	b.mu.Lock()
+	close(b.stop)
+	b.mu.Unlock()
+	b.client.Disconnect()
+	b.starting.Wait()
+	b.conn.mute()
+}
+
+// forget deletes the metrics of the broker that was removed.
+func (b *broker) forget() {
+	b.conn.forget()
+	activeHost.DeletePartialMatch(prometheus.Labels{"broker": b.name})
+	certificateExpiry.DeleteLabelValues(b.name)
+}
+
+// replaceWith deletes the metrics of the closed broker that
+// the broker nb replacing it does not report.
+func (b *broker) replaceWith(nb *broker) {
+	if b.conn.name != nb.conn.name {
+		b.conn.forget()
+	}
+	kept := make(map[string]bool, len(nb.hosts))
+	for _, h := range nb.hosts {
+		kept[h] = true
+	}
+	for _, h := range b.hosts {
+		if !kept[h] {
+			activeHost.DeleteLabelValues(b.name, h)
+		}
+	}
+	if nb.cfg.ClientCert == "" && nb.cfg.ClientCertPath == "" {
+		certificateExpiry.DeleteLabelValues(b.name)
+	}
+}
+
+// subscribe subscribes to the topic filter of the import route. If client
+// is not connected, it subscribes once the connection is established.
+func (b *broker) subscribe(filter string, qos byte) {
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+	if err := b.client.Subscribe(filter, qos); err != nil {
+		b.logger.Error(fmt.Sprintf("Failed to subscribe to %s on broker %s: %s", filter, b.name, err))
+		return
+	}
+	b.logger.Debug(fmt.Sprintf("Client %s subscribed to %s on broker %s", b.clientID(), filter, b.name))
+}
+
+func (b *broker) unsubscribe(filter string) {
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+	if err := b.client.Unsubscribe(filter); err != nil {
+		b.logger.Warn(fmt.Sprintf("Failed to unsubscribe from %s on broker %s: %s", filter, b.name, err))
+	}
+}
+
+// received passes the message received over MQTT to the import routes.
+func (b *broker) received(topic string, payload []byte, props map[string]string) {
+	if b.onMessage != nil {
+		b.onMessage(topic, payload, props)
+	}
+}
+
+// offline publishes the will message before the client disconnects on
+// purpose, since the broker publishes it only if the connection is lost.
+func (b *broker) offline() {
+	m := b.will
+	if m == nil || !b.client.IsConnectionOpen() {
+		return
+	}
+	if err := b.client.Publish(m.topic, m.payload, m.qos, m.retain, messages.Options{}); err != nil {
+		b.logger.Warn(fmt.Sprintf("Failed to publish will message to broker %s: %s", b.name, err))
+	}
+}
+
+func (b *broker) clientID() string {
+	if b.cfg.ClientID != "" {
+		return b.cfg.ClientID
+	}
+	return fmt.Sprintf("export-%s", b.cfg.Username)
+}
+
+// tlsConfig returns TLS configuration of the client, or nil if TLS is off.
+// Client certificate is presented only with mutual TLS. Configuration uses
+// the certificates loaded at the time it is created.
+func (b *broker) tlsConfig() *tls.Config {
+	conf := b.cfg
+	mode := conf.TLS()
+	if mode == config.TLSOff {
+		return nil
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: conf.SkipTLSVer,
+		ServerName:         conf.ServerName,
+	}
+	// Version is validated by brokerConfigs.
+	cfg.MinVersion, _ = tlsVersion(conf.MinTLSVersion)
+	cfg.RootCAs = b.certs.roots()
+	if mode == config.TLSMutual {
+		cfg.GetClientCertificate = b.certs.clientCertificate
+	}
+	return cfg
+}
@@ -0,0 +1,299 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// Certificates are checked for expiry every certCheckInterval
+	// and warning is logged once they expire within certExpiryWarning.
+	certCheckInterval = time.Hour
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+var (
+	errLoadCert = errors.New("failed loading client certificate")
+	errLoadCA   = errors.New("failed loading CA certificate")
+
+	errNoCert           = errors.New("client certificate is not configured")
+	errNoPEM            = errors.New("no PEM data found")
+	errNoPassphrase     = errors.New("key is encrypted, but passphrase is not set")
+	errLegacyEncryption = errors.New("legacy PEM encryption is not supported, convert the key to encrypted PKCS#8")
+)
+
+// certs holds the certificates of the broker. Certificates are loaded from
+// the files, so they can be replaced while the client is running, or from
+// the configuration if the paths are not set.
+type certs struct {
+	cfg  config.MQTT
+	mu   sync.RWMutex
+	ca   []byte
+	pool *x509.CertPool
+	cert *tls.Certificate
+	// Raw certificate and key, used to detect the changes.
+	raw [][]byte
+	// NotAfter of the client certificate, zero if there is none.
+	notAfter time.Time
+}
+
+func newCerts(cfg config.MQTT) (*certs, error) {
+	c := &certs{cfg: cfg}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the certificates and reports whether they changed.
+// Certificates in use are kept if loading fails.
+func (c *certs) load() (bool, error) {
+	cfg := c.cfg
+	mode := cfg.TLS()
+	if mode == config.TLSOff {
+		return false, nil
+	}
+	ca := cfg.CA
+	if cfg.CAPath != "" {
+		b, err := os.ReadFile(cfg.CAPath)
+		if err != nil {
+			return false, errors.Wrap(errLoadCA, err)
+		}
+		ca = b
+	}
+	var pool *x509.CertPool
+	if ca != nil {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return false, errLoadCA
+		}
+	}
+	if mode != config.TLSMutual {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		changed := !bytes.Equal(c.ca, ca)
+		c.ca, c.pool = ca, pool
+		return changed, nil
+	}
+
+	tc, err := loadKeyPair(cfg)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		return false, certError("client certificate", "parse certificate", err)
+	}
+	tc.Leaf = leaf
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := !bytes.Equal(c.ca, ca) || !equalRaw(c.raw, tc.Certificate)
+	c.ca, c.pool = ca, pool
+	c.cert = &tc
+	c.raw = tc.Certificate
+	c.notAfter = leaf.NotAfter
+	return changed, nil
+}
+
+// certError describes the source of the certificate and the step of loading that failed.
+func certError(source, step string, err error) error {
+	return errors.Wrap(errLoadCert, fmt.Errorf("%s: %s: %w", source, step, err))
+}
+
+// loadKeyPair loads the client certificate from PKCS#12 bundle, from PEM files
+// or from the configuration, in that order.
+func loadKeyPair(cfg config.MQTT) (tls.Certificate, error) {
+	if cfg.ClientP12Path != "" {
+		return loadP12(cfg)
+	}
+	read := func(path, value, name string) ([]byte, string, error) {
+		if path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, path, certError(path, "read", err)
+			}
+			if len(b) > 0 {
+				return b, path, nil
+			}
+		}
+		if value != "" {
+			return []byte(value), name, nil
+		}
+		return nil, name, nil
+	}
+	cert, certSrc, err := read(cfg.ClientCertPath, cfg.ClientCert, "client_cert")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, keySrc, err := read(cfg.ClientPrivKeyPath, cfg.ClientCertKey, "client_cert_key")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	switch {
+	case cert != nil && key != nil:
+		return pemKeyPair(cfg, cert, certSrc, key, keySrc)
+	case cfg.TLSCert.Certificate != nil:
+		return cfg.TLSCert, nil
+	default:
+		return tls.Certificate{}, errors.Wrap(errLoadCert, errNoCert)
+	}
+}
+
+// pemKeyPair parses PEM certificate chain and private key,
+// which can be encrypted PKCS#8 key.
+func pemKeyPair(cfg config.MQTT, cert []byte, certSrc string, key []byte, keySrc string) (tls.Certificate, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return tls.Certificate{}, certError(keySrc, "decode PEM", errNoPEM)
+	}
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		pass, err := passphrase(cfg)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if pass == "" {
+			return tls.Certificate{}, certError(keySrc, "decrypt PKCS#8 key", errNoPassphrase)
+		}
+		pk, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(pass))
+		if err != nil {
+			return tls.Certificate{}, certError(keySrc, "decrypt PKCS#8 key", err)
+		}
+		if key, err = marshalKey(pk); err != nil {
+			return tls.Certificate{}, certError(keySrc, "decrypt PKCS#8 key", err)
+		}
+	case strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"):
+		return tls.Certificate{}, certError(keySrc, "decrypt key", errLegacyEncryption)
+	}
+	tc, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return tls.Certificate{}, certError(certSrc+", "+keySrc, "parse key pair", err)
+	}
+	return tc, nil
+}
+
+// loadP12 loads the client certificate, key and chain from PKCS#12 bundle.
+func loadP12(cfg config.MQTT) (tls.Certificate, error) {
+	path := cfg.ClientP12Path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, certError(path, "read", err)
+	}
+	pass, err := passphrase(cfg)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pk, leaf, chain, err := pkcs12.DecodeChain(data, pass)
+	if err != nil {
+		return tls.Certificate{}, certError(path, "decode PKCS#12", err)
+	}
+	var cert []byte
+	for _, c := range append([]*x509.Certificate{leaf}, chain...) {
+		cert = append(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	key, err := marshalKey(pk)
+	if err != nil {
+		return tls.Certificate{}, certError(path, "decode PKCS#12", err)
+	}
+	tc, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return tls.Certificate{}, certError(path, "parse key pair", err)
+	}
+	return tc, nil
+}
+
+// marshalKey encodes the private key as PEM, so key pair can be checked by tls package.
+func marshalKey(pk interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// passphrase returns the passphrase of the client key from the secret file
+// or from the environment variable.
+func passphrase(cfg config.MQTT) (string, error) {
+	if cfg.KeyPassphraseFile != "" {
+		b, err := os.ReadFile(cfg.KeyPassphraseFile)
+		if err != nil {
+			return "", certError(cfg.KeyPassphraseFile, "read passphrase", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if cfg.KeyPassphraseEnv != "" {
+		return os.Getenv(cfg.KeyPassphraseEnv), nil
+	}
+	return "", nil
+}
+
+func equalRaw(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientCertificate returns the current client certificate.
+func (c *certs) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
+
+// roots returns the CA certificates, or nil to use the system ones.
+func (c *certs) roots() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pool
+}
+
+func (c *certs) expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.notAfter
+}
+
+// files returns the certificate files that are watched for changes.
+func (c *certs) files() []string {
+	mode := c.cfg.TLS()
+	if mode == config.TLSOff {
+		return nil
+	}
+	var files []string
+	if c.cfg.CAPath != "" {
+		files = append(files, c.cfg.CAPath)
+	}
+	if mode == config.TLSMutual {
+		for _, f := range []string{c.cfg.ClientCertPath, c.cfg.ClientPrivKeyPath, c.cfg.ClientP12Path, c.cfg.KeyPassphraseFile} {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
@@ -0,0 +1,342 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Messages that routes fail to process are stored in this stream
+	// of the cache, so they can be inspected and retried later.
+	deadLetterStream = "deadletter"
+	// Stored dead letters are limited to this size, unless configured.
+	deadLetterMaxSize = 10 * 1024 * 1024
+)
+
+var (
+	// ErrDeadLetterNotFound indicates non-existent dead letter.
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+	errBadDeadLetter = errors.New("Bad dead letter")
+)
+
+// DeadLetter is the message that route failed to process. Payload is the
+// original payload received from the message bus and Created is the time
+// when the message was dead-lettered. ID is set for stored dead letters.
+type DeadLetter struct {
+	ID        string    `json:"id,omitempty"`
+	Route     string    `json:"route"`
+	Error     string    `json:"error"`
+	Channel   string    `json:"channel"`
+	Subtopic  string    `json:"subtopic,omitempty"`
+	Publisher string    `json:"publisher,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Payload   []byte    `json:"payload"`
+	Created   time.Time `json:"created"`
+}
+
+// RetryResult contains the number of dead letters that were published
+// and the errors of the ones that failed again, by their IDs.
+type RetryResult struct {
+	Retried int               `json:"retried"`
+	Failed  int               `json:"failed"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// deadLetter stores the message and publishes it to the dead letter
+// NATS subject and MQTT topic, if they are configured.
+func (e *exporter) deadLetter(route string, msg *messaging.Message, reason error) {
+	deadLetters.WithLabelValues(route).Inc()
+	now := time.Now()
+	if e.cache != nil {
+		m, err := encodeDeadLetter(route, msg, reason, now)
+		if err == nil {
+			_, err = e.cache.Add(deadLetterStream, m)
+		}
+		if err != nil && err != messages.ErrDropped {
+			e.logger.Error(fmt.Sprintf("Failed to store dead letter of route %s: %s", route, err))
+		}
+	}
+
+	e.RLock()
+	dc := e.cfg.DeadLetter
+	e.RUnlock()
+	if dc == nil || (dc.NatsSubject == "" && dc.MqttTopic == "") {
+		return
+	}
+	data, err := json.Marshal(newDeadLetter(route, msg, reason.Error(), now))
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("Failed to encode dead letter of route %s: %s", route, err))
+		return
+	}
+	if dc.NatsSubject != "" {
+		m := &messaging.Message{
+			Channel:   dc.NatsSubject,
+			Publisher: svcName,
+			Created:   now.UnixNano(),
+			Payload:   data,
+		}
+		if err := e.pubsub.Publish(context.Background(), dc.NatsSubject, m); err != nil {
+			e.logger.Error(fmt.Sprintf("Failed to publish dead letter of route %s to NATS %s: %s", route, dc.NatsSubject, err))
+		}
+	}
+	if dc.MqttTopic != "" {
+		// Dead letters go to the broker of the route and are not buffered.
+		b, err := e.broker(streamPrefix + "." + route)
+		if err == nil && (isNATS(b.cfg) || isHTTP(b.cfg)) {
+			// NATS servers and HTTP endpoints are not MQTT brokers.
+			return
+		}
+		if err == nil {
+			err = b.publish(dc.MqttTopic, data, messages.Options{})
+		}
+		if err != nil {
+			e.logger.Error(fmt.Sprintf("Failed to publish dead letter of route %s to MQTT %s: %s", route, dc.MqttTopic, err))
+		}
+	}
+}
+
+// reject dead-letters the message if the target rejected it, so it is
+// neither stored nor published again. Dead letter is the message the route
+// received, so retrying it processes the message again. Messages published
+// without the source are dead-lettered with the payload, and the channel
+// and subtopic taken from their key.
+func (e *exporter) reject(stream string, payload []byte, o messages.Options, err error) bool {
+	if !errors.Contains(err, errHTTPRejected) {
+		return false
+	}
+	route := routeLabel(stream)
+	e.logger.Warn(fmt.Sprintf("Message of route %s was rejected: %s", route, err))
+	msg := &messaging.Message{}
+	if len(o.Source) == 0 || proto.Unmarshal(o.Source, msg) != nil {
+		channel, subtopic, _ := strings.Cut(o.Key, ".")
+		msg = &messaging.Message{
+			Channel:  channel,
+			Subtopic: subtopic,
+			Payload:  payload,
+		}
+		if !o.Created.IsZero() {
+			msg.Created = o.Created.UnixNano()
+		}
+	}
+	e.deadLetter(route, msg, err)
+	return true
+}
+
+func (e *exporter) ListDeadLetters(limit int64) ([]DeadLetter, error) {
+	if e.cache == nil {
+		return nil, errNoCacheConfigured
+	}
+	entries, err := e.cache.Read(deadLetterStream, limit)
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]DeadLetter, 0, len(entries))
+	for _, en := range entries {
+		dl, _, err := decodeDeadLetter(en)
+		if err != nil {
+			e.logger.Warn(fmt.Sprintf("Skipping dead letter %s: %s", en.ID, err))
+			continue
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+func (e *exporter) RetryDeadLetters(ids ...string) (RetryResult, error) {
+	e.deadLettersMu.Lock()
+	defer e.deadLettersMu.Unlock()
+	res := RetryResult{Errors: make(map[string]string)}
+	err := e.eachDeadLetters(ids, func(entries []messages.Entry) error {
+		for _, en := range entries {
+			if err := e.retry(en); err != nil {
+				res.Failed++
+				res.Errors[en.ID] = err.Error()
+				continue
+			}
+			if err := e.cache.Remove(deadLetterStream, en.ID); err != nil {
+				return err
+			}
+			res.Retried++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// retry processes the dead letter by its route and publishes it.
+func (e *exporter) retry(en messages.Entry) error {
+	dl, msg, err := decodeDeadLetter(en)
+	if err != nil {
+		return err
+	}
+	e.RLock()
+	r, ok := e.consumers[dl.Route]
+	e.RUnlock()
+	if !ok {
+		return errors.Wrap(ErrNotFound, errors.New(dl.Route))
+	}
+	payload, props, err := r.process(msg)
+	if err != nil {
+		return err
+	}
+	return r.publish(msg, payload, props)
+}
+
+func (e *exporter) PurgeDeadLetters(ids ...string) (int, error) {
+	e.deadLettersMu.Lock()
+	defer e.deadLettersMu.Unlock()
+	n := 0
+	err := e.eachDeadLetters(ids, func(entries []messages.Entry) error {
+		rm := make([]string, len(entries))
+		for i, en := range entries {
+			rm[i] = en.ID
+		}
+		if err := e.cache.Remove(deadLetterStream, rm...); err != nil {
+			return err
+		}
+		n += len(rm)
+		return nil
+	})
+	return n, err
+}
+
+// eachDeadLetters calls fn with the stored dead letters with given IDs,
+// or with all of them if no IDs are given. All the dead letters are read
+// in pages of replayBatch, so the stream is not loaded into memory at once.
+func (e *exporter) eachDeadLetters(ids []string, fn func([]messages.Entry) error) error {
+	if e.cache == nil {
+		return errNoCacheConfigured
+	}
+	if len(ids) > 0 {
+		entries := make([]messages.Entry, 0, len(ids))
+		for _, id := range ids {
+			en, err := e.cache.Range(deadLetterStream, id, id, 1)
+			switch {
+			case errors.Contains(err, messages.ErrInvalidID) || (err == nil && len(en) == 0):
+				return errors.Wrap(ErrDeadLetterNotFound, errors.New(id))
+			case err != nil:
+				return err
+			}
+			entries = append(entries, en[0])
+		}
+		return fn(entries)
+	}
+	last := ""
+	for {
+		entries, err := e.cache.Range(deadLetterStream, last, "", replayBatch)
+		if err != nil {
+			return err
+		}
+		n := len(entries)
+		// Range includes the last dead letter of the previous page,
+		// unless it was removed.
+		if last != "" && n > 0 && entries[0].ID == last {
+			entries = entries[1:]
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := fn(entries); err != nil {
+			return err
+		}
+		if n < replayBatch {
+			return nil
+		}
+		last = entries[len(entries)-1].ID
+	}
+}
+
+func newDeadLetter(route string, msg *messaging.Message, reason string, created time.Time) DeadLetter {
+	return DeadLetter{
+		Route:     route,
+		Error:     reason,
+		Channel:   msg.Channel,
+		Subtopic:  msg.Subtopic,
+		Publisher: msg.Publisher,
+		Protocol:  msg.Protocol,
+		Payload:   msg.Payload,
+		Created:   created,
+	}
+}
+
+// encodeDeadLetter encodes the dead letter as the message of the cache, so
+// the retention applies to it as to the route streams. Topic is the route,
+// payload is the protobuf encoded message and key is its channel and subtopic.
+func encodeDeadLetter(route string, msg *messaging.Message, reason error, created time.Time) (map[string]interface{}, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := messages.Msg{
+		Topic:      route,
+		Payload:    string(data),
+		Created:    created.UnixNano(),
+		Origin:     msg.Created,
+		Key:        msg.Channel,
+		Properties: map[string]string{"error": reason.Error()},
+	}
+	if msg.Subtopic != "" {
+		m.Key = fmt.Sprintf("%s.%s", msg.Channel, msg.Subtopic)
+	}
+	return m.Encode(), nil
+}
+
+func decodeDeadLetter(en messages.Entry) (DeadLetter, *messaging.Message, error) {
+	var m messages.Msg
+	if err := m.Decode(en.Values); err != nil {
+		return DeadLetter{}, nil, errors.Wrap(errBadDeadLetter, err)
+	}
+	var msg messaging.Message
+	if err := proto.Unmarshal([]byte(m.Payload), &msg); err != nil {
+		return DeadLetter{}, nil, errors.Wrap(errBadDeadLetter, err)
+	}
+	dl := newDeadLetter(m.Topic, &msg, m.Properties["error"], time.Unix(0, m.Created))
+	dl.ID = en.ID
+	return dl, &msg, nil
+}
+
+// deadLetterRetention returns the retention of the stored dead letters,
+// which are limited to deadLetterMaxSize if neither limit is configured.
+func deadLetterRetention(dc *config.DeadLetter) (messages.Retention, error) {
+	if dc == nil {
+		dc = &config.DeadLetter{}
+	}
+	r, err := retention(config.Route{
+		MaxBufferSize: dc.MaxBufferSize,
+		MaxBufferAge:  dc.MaxBufferAge,
+		Overflow:      dc.Overflow,
+	})
+	if err != nil {
+		return r, errors.Wrap(errBadRetention, err)
+	}
+	if r.MaxSize == 0 && r.MaxAge == 0 {
+		r.MaxSize = deadLetterMaxSize
+	}
+	return r, nil
+}
+
+// isDeadLetter checks if the message is the dead letter published to the
+// message bus. Routes drop such messages, so dead letter that they fail to
+// process doesn't produce another one.
+func (e *exporter) isDeadLetter(msg *messaging.Message) bool {
+	if msg.Publisher != svcName {
+		return false
+	}
+	e.RLock()
+	dc := e.cfg.DeadLetter
+	e.RUnlock()
+	return dc != nil && dc.NatsSubject != "" && msg.Channel == dc.NatsSubject
+}
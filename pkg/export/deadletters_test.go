@@ -0,0 +1,222 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/export/pkg/messages/file"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+	"google.golang.org/protobuf/proto"
+)
+
+var errTestProcess = errors.New("failed to process")
+
+// bus delivers the published messages to the handlers subscribed to the
+// subjects with > wildcard, the same way as the message bus does.
+type bus struct {
+	mu        sync.Mutex
+	handlers  map[string]messaging.MessageHandler
+	published int
+}
+
+func (b *bus) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	b.mu.Lock()
+	b.published++
+	var hs []messaging.MessageHandler
+	for subject, h := range b.handlers {
+		if strings.HasPrefix(Channels+"."+topic, strings.TrimSuffix(subject, NatsAll)) {
+			hs = append(hs, h)
+		}
+	}
+	b.mu.Unlock()
+	for _, h := range hs {
+		if err := h.Handle(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bus) Subscribe(ctx context.Context, id, topic string, h messaging.MessageHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = h
+	return nil
+}
+
+func (b *bus) Unsubscribe(ctx context.Context, id, topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, topic)
+	return nil
+}
+
+func (b *bus) Close() error {
+	return nil
+}
+
+func (b *bus) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published
+}
+
+func TestDeadLetterLoop(t *testing.T) {
+	e := newTestExporter(0, config.MQTT{Host: testHost})
+	ps := &bus{handlers: make(map[string]messaging.MessageHandler)}
+	e.pubsub, e.subs = ps, make(map[string]*subscription)
+	e.cfg.DeadLetter = &config.DeadLetter{NatsSubject: "export.deadletter"}
+	// Route on channels subject receives the dead letters published to the bus.
+	r, err := e.newRoute(config.Route{Name: "mfx", NatsTopic: Channels, MqttTopic: Channels, Type: mainfluxType})
+	if err != nil {
+		t.Fatalf("unexpected error creating route: %s", err)
+	}
+	e.consumers[r.Name] = r
+	r.Run()
+	e.attach(context.Background(), r)
+	defer func() {
+		r.Close()
+		r.Wait()
+	}()
+
+	// Payload of mfx route message is not protobuf, so it is dead-lettered.
+	if err := ps.Publish(context.Background(), "1", testMessage("not proto")); err != nil {
+		t.Fatalf("unexpected error publishing message: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ps.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Dead letter would be dead-lettered again if route processed it.
+	time.Sleep(100 * time.Millisecond)
+	if n := ps.count(); n != 2 {
+		t.Errorf("expected message and 1 dead letter published, got %d messages", n)
+	}
+}
+
+func TestDeadLetterRetention(t *testing.T) {
+	msg := testMessage("not proto")
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unexpected error encoding message: %s", err)
+	}
+	// Size of the dead letter is the size of its route and message.
+	size := int64(len("r") + len(data))
+	cases := []struct {
+		desc  string
+		dc    *config.DeadLetter
+		added int
+		want  int
+	}{
+		{
+			desc:  "default limit",
+			added: 5,
+			want:  5,
+		},
+		{
+			desc:  "size limit",
+			dc:    &config.DeadLetter{MaxBufferSize: 3 * size},
+			added: 5,
+			want:  3,
+		},
+		{
+			desc:  "age limit",
+			dc:    &config.DeadLetter{MaxBufferAge: "1h"},
+			added: 5,
+			want:  5,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			e := newTestDeadLetters(t, tc.dc)
+			for i := 0; i < tc.added; i++ {
+				e.deadLetter("r", msg, errTestProcess)
+			}
+			dls, err := e.ListDeadLetters(int64(tc.added))
+			if err != nil {
+				t.Fatalf("unexpected error listing dead letters: %s", err)
+			}
+			if len(dls) != tc.want {
+				t.Errorf("expected %d dead letters, got %d", tc.want, len(dls))
+			}
+		})
+	}
+}
+
+func TestDeadLetterLookup(t *testing.T) {
+	e := newTestDeadLetters(t, nil)
+	// More dead letters than fit into a single page.
+	n := 2*replayBatch + 1
+	for i := 0; i < n; i++ {
+		e.deadLetter("r", testMessage(fmt.Sprint(i)), errTestProcess)
+	}
+	dls, err := e.ListDeadLetters(1)
+	if err != nil || len(dls) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d: %v", len(dls), err)
+	}
+	first := dls[0]
+	if first.Route != "r" || first.Error != errTestProcess.Error() || string(first.Payload) != "0" {
+		t.Errorf("expected dead letter of route r with payload 0, got %+v", first)
+	}
+
+	cases := []struct {
+		desc string
+		ids  []string
+		err  error
+	}{
+		{desc: "unknown ID", ids: []string{"1000000"}, err: ErrDeadLetterNotFound},
+		{desc: "invalid ID", ids: []string{"first"}, err: ErrDeadLetterNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := e.RetryDeadLetters(tc.ids...); !errors.Contains(err, tc.err) {
+				t.Errorf("retry: expected error %s, got %v", tc.err, err)
+			}
+			if _, err := e.PurgeDeadLetters(tc.ids...); !errors.Contains(err, tc.err) {
+				t.Errorf("purge: expected error %s, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// Route of the dead letters is unknown, so they all fail and are kept.
+	res, err := e.RetryDeadLetters()
+	if err != nil {
+		t.Fatalf("unexpected error retrying dead letters: %s", err)
+	}
+	if res.Failed != n || res.Retried != 0 {
+		t.Errorf("expected %d failed dead letters, got %d failed and %d retried", n, res.Failed, res.Retried)
+	}
+	removed, err := e.PurgeDeadLetters(first.ID)
+	if err != nil || removed != 1 {
+		t.Errorf("expected 1 dead letter purged, got %d: %v", removed, err)
+	}
+	removed, err = e.PurgeDeadLetters()
+	if err != nil || removed != n-1 {
+		t.Errorf("expected %d dead letters purged, got %d: %v", n-1, removed, err)
+	}
+}
+
+// newTestDeadLetters returns the exporter which stores dead letters
+// into the file cache, with retention of the dead letter section.
+func newTestDeadLetters(t *testing.T, dc *config.DeadLetter) *exporter {
+	t.Helper()
+	c, err := file.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error creating cache: %s", err)
+	}
+	e := newTestExporter(0, config.MQTT{Host: testHost})
+	e.cache = messages.NewRetentionCache(c, nil)
+	e.cfg.DeadLetter = dc
+	e.initDeadLetters()
+	return e
+}
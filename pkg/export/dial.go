@@ -0,0 +1,165 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	errUnsupportedScheme = errors.New("unsupported scheme")
+	errProxy             = errors.New("proxy refused connection")
+)
+
+// validateProxy checks if the proxy URL is supported.
+func validateProxy(p string) error {
+	if p == "" {
+		return nil
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+		return nil
+	default:
+		return errors.Wrap(errUnsupportedScheme, errors.New(u.Scheme))
+	}
+}
+
+// open opens the connection to the broker host. TLS configuration
+// is created for every connection, so it uses the current certificates.
+func (b *broker) open(u *url.URL) (net.Conn, error) {
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return b.dial(address(u), connectTimeout)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		conn, err := b.dial(address(u), connectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		cfg := b.tlsConfig()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	case "ws", "wss":
+		return b.websocket(u)
+	case "unix":
+		d := &net.Dialer{Timeout: connectTimeout}
+		if u.Host != "" {
+			return d.Dial("unix", u.Host)
+		}
+		return d.Dial("unix", u.Path)
+	default:
+		return nil, errors.Wrap(errUnsupportedScheme, errors.New(u.Scheme))
+	}
+}
+
+// websocket opens MQTT over WebSocket connection. Path is taken from
+// the host URL, or from the broker configuration if URL has no path.
+func (b *broker) websocket(u *url.URL) (net.Conn, error) {
+	ws := *u
+	if ws.Path == "" {
+		ws.Path = b.cfg.WSPath
+	}
+	headers := http.Header{}
+	for k, v := range b.cfg.WSHeaders {
+		headers.Set(k, v)
+	}
+	opts := &mqtt.WebsocketOptions{}
+	if b.cfg.Proxy != "" {
+		// Proxy is validated by brokerConfigs.
+		p, _ := url.Parse(b.cfg.Proxy)
+		opts.Proxy = http.ProxyURL(p)
+	}
+	var cfg *tls.Config
+	if u.Scheme == "wss" {
+		cfg = b.tlsConfig()
+	}
+	return mqtt.NewWebsocket(ws.String(), cfg, connectTimeout, headers, opts)
+}
+
+// dial opens TCP connection to the address through the proxy. If proxy is not
+// set, proxy from the environment is used, same as MQTT client does.
+func (b *broker) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if b.cfg.Proxy == "" {
+		return proxy.FromEnvironmentUsing(d).Dial("tcp", addr)
+	}
+	p, _ := url.Parse(b.cfg.Proxy)
+	if p.Scheme == "http" {
+		return connectProxy(d, p, addr)
+	}
+	pd, err := proxy.FromURL(p, d)
+	if err != nil {
+		return nil, err
+	}
+	return pd.Dial("tcp", addr)
+}
+
+// connectProxy opens the tunnel to the address using HTTP CONNECT method.
+func connectProxy(d *net.Dialer, p *url.URL, addr string) (net.Conn, error) {
+	host := p.Host
+	if p.Port() == "" {
+		host = net.JoinHostPort(p.Hostname(), "80")
+	}
+	conn, err := d.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Broker doesn't send anything before the client does,
+	// so the reader doesn't buffer any of the tunneled data.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Wrap(errProxy, fmt.Errorf("%s", resp.Status))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,216 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+const (
+	// MQTT 5 user property with comma separated IDs of the exporters
+	// that published the message.
+	hopsProperty = "hops"
+
+	// Reasons the message is not published.
+	loopReason    = "loop"
+	maxHopsReason = "max_hops"
+
+	// Trails of imported messages are kept for this long, so export
+	// routes that receive them from the message bus continue the trail.
+	trailTTL = time.Minute
+)
+
+var (
+	errBadInstanceID = errors.New("Bad instance ID")
+	errBadMaxHops    = errors.New("Bad max hops")
+	errNoHopTrail    = errors.New("broker with import and export routes must carry hop trail, set hop_trail to envelope or off")
+)
+
+// envelope wraps the payload of the message published with the hop trail.
+type envelope struct {
+	Hops    []string `json:"hops"`
+	Payload []byte   `json:"payload"`
+}
+
+// trails remembers hop trails of the imported messages.
+type trails struct {
+	mu      sync.Mutex
+	entries map[string]trail
+	pruned  time.Time
+}
+
+type trail struct {
+	hops    []string
+	expires time.Time
+}
+
+func (t *trails) add(msg *messaging.Message, hops []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.entries == nil {
+		t.entries = make(map[string]trail)
+	}
+	if now.Sub(t.pruned) > trailTTL {
+		for k, tr := range t.entries {
+			if now.After(tr.expires) {
+				delete(t.entries, k)
+			}
+		}
+		t.pruned = now
+	}
+	t.entries[trailKey(msg)] = trail{hops: hops, expires: now.Add(trailTTL)}
+}
+
+func (t *trails) get(msg *messaging.Message) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.entries[trailKey(msg)]
+	if !ok || time.Now().After(tr.expires) {
+		return nil
+	}
+	return tr.hops
+}
+
+// trailKey identifies the message on the message bus.
+func trailKey(msg *messaging.Message) string {
+	h := sha256.New()
+	for _, s := range []string{msg.Channel, msg.Subtopic, msg.Publisher, strconv.FormatInt(msg.Created, 10)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(msg.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkTrails checks that brokers with both import and export routes carry
+// the hop trail, so messages exported by the other exporters are not exported
+// back to them. Trail is carried by default only over MQTT 5, the other
+// brokers have to choose it explicitly.
+func checkTrails(routes map[string]*Route, cfgs map[string]config.MQTT) error {
+	imports, exports := make(map[string]bool), make(map[string]bool)
+	for _, r := range routes {
+		if r.Direction == config.DirectionImport {
+			imports[r.Broker] = true
+			continue
+		}
+		exports[r.Broker] = true
+	}
+	for name := range imports {
+		cfg := cfgs[name]
+		if exports[name] && cfg.HopTrail == "" && cfg.ProtocolVersion != mqtt5 {
+			return errors.Wrap(errNoHopTrail, errors.New(name))
+		}
+	}
+	return nil
+}
+
+// instanceID returns the ID of the exporter, which defaults to host name.
+func instanceID(c config.Server) (string, error) {
+	if c.MaxHops < 0 {
+		return "", errors.Wrap(errBadMaxHops, errors.New(strconv.Itoa(c.MaxHops)))
+	}
+	if c.InstanceID != "" {
+		if strings.ContainsAny(c.InstanceID, ", \t\r\n") {
+			return "", errors.Wrap(errBadInstanceID, errors.New(c.InstanceID))
+		}
+		return c.InstanceID, nil
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h, nil
+	}
+	return svcName, nil
+}
+
+// suppressed checks if the message with the hop trail already passed through
+// the exporter or through too many exporters. Exported message can't reach
+// the limit, since the exporter is added to its trail.
+func (e *exporter) suppressed(r *Route, hops []string, export bool) bool {
+	reason := ""
+	for _, h := range hops {
+		if h == e.instanceID {
+			reason = loopReason
+		}
+	}
+	if reason == "" && e.maxHops > 0 && (len(hops) > e.maxHops || (export && len(hops) == e.maxHops)) {
+		reason = maxHopsReason
+	}
+	if reason == "" {
+		return false
+	}
+	suppressedLoops.WithLabelValues(routeLabel(r.Stream), reason).Inc()
+	e.logger.Debug(fmt.Sprintf("Suppressed message on route %s with hops %s: %s", r.Name, strings.Join(hops, ","), reason))
+	return true
+}
+
+// addHop adds the exporter to the hop trail of the message published by the
+// export route. It returns false if the message must not be published.
+func (e *exporter) addHop(r *Route, msg *messaging.Message, payload []byte, props map[string]string) ([]byte, map[string]string, bool) {
+	hops := e.trails.get(msg)
+	if e.suppressed(r, hops, true) {
+		return nil, nil, false
+	}
+	hops = append(hops[:len(hops):len(hops)], e.instanceID)
+
+	e.RLock()
+	b, ok := e.brokers[r.Broker]
+	e.RUnlock()
+	if !ok {
+		return payload, props, true
+	}
+	switch b.cfg.HopTrail {
+	case config.HopTrailOff:
+		return payload, props, true
+	case config.HopTrailEnvelope:
+		data, err := json.Marshal(envelope{Hops: hops, Payload: payload})
+		if err != nil {
+			e.logger.Error(fmt.Sprintf("Failed to wrap message on route %s: %s", r.Name, err))
+			return nil, nil, false
+		}
+		return data, props, true
+	default:
+		if b.cfg.ProtocolVersion != mqtt5 {
+			return payload, props, true
+		}
+		ps := make(map[string]string, len(props)+1)
+		for k, v := range props {
+			ps[k] = v
+		}
+		ps[hopsProperty] = strings.Join(hops, ",")
+		return payload, ps, true
+	}
+}
+
+// trail returns the hop trail of the message received from the broker
+// and its payload, unwrapped if the broker uses envelopes. Payloads that
+// are not envelopes are returned as they are.
+func (b *broker) trail(payload []byte, props map[string]string) ([]string, []byte) {
+	switch b.cfg.HopTrail {
+	case config.HopTrailOff:
+		return nil, payload
+	case config.HopTrailEnvelope:
+		var env envelope
+		if err := json.Unmarshal(payload, &env); err != nil || env.Hops == nil {
+			return nil, payload
+		}
+		return env.Hops, env.Payload
+	default:
+		if h := props[hopsProperty]; h != "" {
+			return strings.Split(h, ","), payload
+		}
+		return nil, payload
+	}
+}
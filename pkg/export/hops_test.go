@@ -0,0 +1,413 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+const instance = "edge-1"
+
+func newTestExporter(maxHops int, cfg config.MQTT) *exporter {
+	e := &exporter{
+		instanceID: instance,
+		maxHops:    maxHops,
+		logger:     logger.NewMock(),
+		brokers:    make(map[string]*broker),
+		consumers:  make(map[string]*Route),
+	}
+	e.brokers[defaultBroker] = &broker{name: defaultBroker, cfg: cfg}
+	return e
+}
+
+func testMessage(payload string) *messaging.Message {
+	return &messaging.Message{
+		Channel:   "1",
+		Subtopic:  "temp",
+		Publisher: "thing",
+		Created:   1690000000000000000,
+		Payload:   []byte(payload),
+	}
+}
+
+func TestTrails(t *testing.T) {
+	cases := []struct {
+		desc string
+		add  *messaging.Message
+		get  *messaging.Message
+		hops []string
+		want []string
+	}{
+		{
+			desc: "same message",
+			add:  testMessage("a"),
+			get:  testMessage("a"),
+			hops: []string{"cloud", instance},
+			want: []string{"cloud", instance},
+		},
+		{
+			desc: "other payload",
+			add:  testMessage("a"),
+			get:  testMessage("b"),
+			hops: []string{"cloud"},
+			want: nil,
+		},
+		{
+			desc: "other subtopic",
+			add:  testMessage("a"),
+			get:  &messaging.Message{Channel: "1", Subtopic: "hum", Publisher: "thing", Created: 1690000000000000000, Payload: []byte("a")},
+			hops: []string{"cloud"},
+			want: nil,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var tr trails
+			tr.add(tc.add, tc.hops)
+			if got := tr.get(tc.get); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected hops %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTrailExpiry(t *testing.T) {
+	var tr trails
+	msg := testMessage("a")
+	tr.add(msg, []string{"cloud"})
+	tr.entries[trailKey(msg)] = trail{hops: []string{"cloud"}, expires: time.Now().Add(-time.Second)}
+	if got := tr.get(msg); got != nil {
+		t.Errorf("expected expired trail to be ignored, got %v", got)
+	}
+}
+
+func TestSuppressed(t *testing.T) {
+	cases := []struct {
+		desc    string
+		maxHops int
+		hops    []string
+		export  bool
+		want    bool
+	}{
+		{
+			desc: "no trail",
+			want: false,
+		},
+		{
+			desc: "other exporters",
+			hops: []string{"cloud", "edge-2"},
+			want: false,
+		},
+		{
+			desc:   "own ID on export",
+			hops:   []string{"cloud", instance},
+			export: true,
+			want:   true,
+		},
+		{
+			desc: "own ID on import",
+			hops: []string{instance, "cloud"},
+			want: true,
+		},
+		{
+			desc:    "below max hops",
+			maxHops: 3,
+			hops:    []string{"cloud", "edge-2"},
+			export:  true,
+			want:    false,
+		},
+		{
+			desc:    "export reaching max hops",
+			maxHops: 2,
+			hops:    []string{"cloud", "edge-2"},
+			export:  true,
+			want:    true,
+		},
+		{
+			desc:    "import at max hops",
+			maxHops: 2,
+			hops:    []string{"cloud", "edge-2"},
+			want:    false,
+		},
+		{
+			desc:    "import over max hops",
+			maxHops: 1,
+			hops:    []string{"cloud", "edge-2"},
+			want:    true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			e := newTestExporter(tc.maxHops, config.MQTT{})
+			r := &Route{Name: "test", Stream: streamPrefix + ".test"}
+			if got := e.suppressed(r, tc.hops, tc.export); got != tc.want {
+				t.Errorf("expected suppressed %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAddHop(t *testing.T) {
+	payload := []byte{0x0a, 0xff}
+	props := map[string]string{"publisher": "thing"}
+	cases := []struct {
+		desc      string
+		cfg       config.MQTT
+		trail     []string
+		ok        bool
+		payload   []byte
+		props     map[string]string
+		enveloped []string
+	}{
+		{
+			desc:    "properties over MQTT 5",
+			cfg:     config.MQTT{ProtocolVersion: mqtt5},
+			ok:      true,
+			payload: payload,
+			props:   map[string]string{"publisher": "thing", hopsProperty: instance},
+		},
+		{
+			desc:    "properties continue trail",
+			cfg:     config.MQTT{ProtocolVersion: mqtt5, HopTrail: config.HopTrailProperties},
+			trail:   []string{"cloud"},
+			ok:      true,
+			payload: payload,
+			props:   map[string]string{"publisher": "thing", hopsProperty: "cloud," + instance},
+		},
+		{
+			desc:    "no properties over MQTT 3.1.1",
+			cfg:     config.MQTT{},
+			ok:      true,
+			payload: payload,
+			props:   props,
+		},
+		{
+			desc:      "envelope",
+			cfg:       config.MQTT{HopTrail: config.HopTrailEnvelope},
+			trail:     []string{"cloud"},
+			ok:        true,
+			props:     props,
+			enveloped: []string{"cloud", instance},
+		},
+		{
+			desc:    "off",
+			cfg:     config.MQTT{ProtocolVersion: mqtt5, HopTrail: config.HopTrailOff},
+			ok:      true,
+			payload: payload,
+			props:   props,
+		},
+		{
+			desc:  "imported by the exporter",
+			cfg:   config.MQTT{ProtocolVersion: mqtt5},
+			trail: []string{"cloud", instance},
+			ok:    false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			e := newTestExporter(0, tc.cfg)
+			r := &Route{Name: "test", Stream: streamPrefix + ".test", Broker: defaultBroker}
+			msg := testMessage("a")
+			if tc.trail != nil {
+				e.trails.add(msg, tc.trail)
+			}
+			p, ps, ok := e.addHop(r, msg, payload, props)
+			if ok != tc.ok {
+				t.Fatalf("expected ok %t, got %t", tc.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(ps, tc.props) {
+				t.Errorf("expected properties %v, got %v", tc.props, ps)
+			}
+			if tc.enveloped == nil {
+				if !reflect.DeepEqual(p, tc.payload) {
+					t.Errorf("expected payload %x, got %x", tc.payload, p)
+				}
+				return
+			}
+			var env envelope
+			if err := json.Unmarshal(p, &env); err != nil {
+				t.Fatalf("expected envelope, got %s: %s", p, err)
+			}
+			if !reflect.DeepEqual(env.Hops, tc.enveloped) {
+				t.Errorf("expected hops %v, got %v", tc.enveloped, env.Hops)
+			}
+			if !reflect.DeepEqual(env.Payload, payload) {
+				t.Errorf("expected payload %x, got %x", payload, env.Payload)
+			}
+		})
+	}
+}
+
+func TestBrokerTrail(t *testing.T) {
+	env, err := json.Marshal(envelope{Hops: []string{"cloud", "edge-2"}, Payload: []byte("a")})
+	if err != nil {
+		t.Fatalf("unexpected error encoding envelope: %s", err)
+	}
+	cases := []struct {
+		desc    string
+		cfg     config.MQTT
+		payload []byte
+		props   map[string]string
+		hops    []string
+		want    []byte
+	}{
+		{
+			desc:    "properties",
+			cfg:     config.MQTT{ProtocolVersion: mqtt5},
+			payload: []byte("a"),
+			props:   map[string]string{hopsProperty: "cloud,edge-2"},
+			hops:    []string{"cloud", "edge-2"},
+			want:    []byte("a"),
+		},
+		{
+			desc:    "no properties",
+			cfg:     config.MQTT{ProtocolVersion: mqtt5},
+			payload: []byte("a"),
+			want:    []byte("a"),
+		},
+		{
+			desc:    "envelope",
+			cfg:     config.MQTT{HopTrail: config.HopTrailEnvelope},
+			payload: env,
+			hops:    []string{"cloud", "edge-2"},
+			want:    []byte("a"),
+		},
+		{
+			desc:    "not envelope",
+			cfg:     config.MQTT{HopTrail: config.HopTrailEnvelope},
+			payload: []byte(`{"temp":21}`),
+			want:    []byte(`{"temp":21}`),
+		},
+		{
+			desc:    "off",
+			cfg:     config.MQTT{HopTrail: config.HopTrailOff},
+			payload: env,
+			props:   map[string]string{hopsProperty: "cloud"},
+			want:    env,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := &broker{cfg: tc.cfg}
+			hops, payload := b.trail(tc.payload, tc.props)
+			if !reflect.DeepEqual(hops, tc.hops) {
+				t.Errorf("expected hops %v, got %v", tc.hops, hops)
+			}
+			if !reflect.DeepEqual(payload, tc.want) {
+				t.Errorf("expected payload %s, got %s", tc.want, payload)
+			}
+		})
+	}
+}
+
+func TestImportedTrail(t *testing.T) {
+	cases := []struct {
+		desc  string
+		props map[string]string
+		want  []string
+	}{
+		{
+			desc: "no trail",
+			want: []string{instance},
+		},
+		{
+			desc:  "trail",
+			props: map[string]string{hopsProperty: "cloud"},
+			want:  []string{"cloud", instance},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			e := newTestExporter(0, config.MQTT{ProtocolVersion: mqtt5})
+			r, err := e.newRoute(config.Route{Name: "in", Direction: config.DirectionImport, MqttTopic: "commands/#", NatsTopic: "1"})
+			if err != nil {
+				t.Fatalf("unexpected error creating route: %s", err)
+			}
+			e.consumers[r.Name] = r
+			e.received(e.brokers[defaultBroker], "commands/temp", []byte("a"), tc.props)
+			var msg *messaging.Message
+			select {
+			case msg = <-r.Messages:
+			default:
+				t.Fatalf("expected message to be imported")
+			}
+			if got := e.trails.get(msg); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected hops %v, got %v", tc.want, got)
+			}
+			// Imported message is not exported again by the same exporter.
+			out := &Route{Name: "out", Stream: streamPrefix + ".out", Broker: defaultBroker}
+			if _, _, ok := e.addHop(out, msg, msg.Payload, nil); ok {
+				t.Errorf("expected imported message not to be exported")
+			}
+		})
+	}
+}
+
+func TestCheckTrails(t *testing.T) {
+	cases := []struct {
+		desc   string
+		cfg    config.MQTT
+		routes []string
+		err    error
+	}{
+		{
+			desc:   "import and export over MQTT 3.1.1",
+			cfg:    config.MQTT{},
+			routes: []string{config.DirectionImport, config.DirectionExport},
+			err:    errNoHopTrail,
+		},
+		{
+			desc:   "import and export with envelope",
+			cfg:    config.MQTT{HopTrail: config.HopTrailEnvelope},
+			routes: []string{config.DirectionImport, config.DirectionExport},
+		},
+		{
+			desc:   "import and export with trail off",
+			cfg:    config.MQTT{HopTrail: config.HopTrailOff},
+			routes: []string{config.DirectionImport, config.DirectionExport},
+		},
+		{
+			desc:   "import and export over MQTT 5",
+			cfg:    config.MQTT{ProtocolVersion: mqtt5},
+			routes: []string{config.DirectionImport, config.DirectionExport},
+		},
+		{
+			desc:   "export only",
+			cfg:    config.MQTT{},
+			routes: []string{config.DirectionExport, config.DirectionExport},
+		},
+		{
+			desc:   "import only",
+			cfg:    config.MQTT{},
+			routes: []string{config.DirectionImport},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			routes := make(map[string]*Route)
+			for i, d := range tc.routes {
+				name := string(rune('a' + i))
+				routes[name] = &Route{Name: name, Direction: d, Broker: defaultBroker}
+			}
+			err := checkTrails(routes, map[string]config.MQTT{defaultBroker: tc.cfg})
+			switch {
+			case tc.err == nil && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Errorf("expected error %s, got %v", tc.err, err)
+			}
+		})
+	}
+}
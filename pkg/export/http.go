@@ -0,0 +1,522 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	// Response body is read up to this size, so the connection can be reused.
+	maxResponseSize = 64 * 1024
+	// Batch is sent after this interval if it is not filled before.
+	defaultBatchInterval = time.Second
+	// Publishers wait while the queue holds this many batches.
+	queueBatches = 4
+)
+
+var (
+	errHTTPImport   = errors.New("import routes are not supported by HTTP endpoints")
+	errHTTPHosts    = errors.New("HTTP endpoints are configured in the http section")
+	errHTTPStatus   = errors.New("HTTP request failed")
+	errHTTPRejected = errors.New("HTTP endpoint rejected the message")
+	errBadEndpoint  = errors.New("Bad HTTP endpoint")
+)
+
+var (
+	_ mqttClient  = (*httpClient)(nil)
+	_ queueClient = (*httpClient)(nil)
+)
+
+// httpClient sends messages to HTTP endpoint as JSON arrays. Messages are
+// queued and sent in batches by the sender goroutine, so publishers don't
+// wait for the batch to fill. Once the request fails after retries, client
+// is disconnected, so the messages are stored in the route streams, and
+// connected again after backoff to republish them. Messages the endpoint
+// rejects fail without disconnecting the client.
+type httpClient struct {
+	b        *broker
+	conf     config.HTTP
+	method   string
+	size     int
+	interval time.Duration
+	capacity int
+
+	mu       sync.Mutex
+	client   *http.Client
+	open     bool
+	failures int
+	// Context of the connection, canceled on disconnect.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Messages waiting to be sent, in order. Queue is flushed when
+	// the messages are sent without waiting for the batch to fill.
+	queue    []*pending
+	flushing bool
+	sending  bool
+	// Wakes the sender once the queue changes. Publishers waiting
+	// for the room in the queue wait for the changed condition.
+	wake    chan struct{}
+	changed *sync.Cond
+	sender  sync.WaitGroup
+}
+
+// pending is the message waiting in the queue.
+type pending struct {
+	msg    httpMessage
+	queued time.Time
+	done   func(error)
+}
+
+// httpMessage is the element of the array sent to the endpoint.
+// Payload is base64 encoded.
+type httpMessage struct {
+	Topic       string            `json:"topic"`
+	Payload     []byte            `json:"payload"`
+	Created     *time.Time        `json:"created,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Properties  map[string]string `json:"properties,omitempty"`
+}
+
+func newHTTPClient(b *broker) *httpClient {
+	c := &httpClient{
+		b:      b,
+		conf:   *b.cfg.HTTP,
+		method: b.cfg.HTTP.Method,
+		size:   b.cfg.HTTP.BatchSize,
+		wake:   make(chan struct{}, 1),
+	}
+	c.changed = sync.NewCond(&c.mu)
+	if c.method == "" {
+		c.method = http.MethodPost
+	}
+	if c.size < 1 {
+		c.size = 1
+	}
+	c.capacity = queueBatches * c.size
+	// Configuration is validated by brokerConfigs.
+	c.interval, _ = time.ParseDuration(c.conf.BatchInterval)
+	if c.interval == 0 {
+		c.interval = defaultBatchInterval
+	}
+	return c
+}
+
+// Connect checks that the endpoint is reachable and starts the sender. TLS
+// configuration is created on connect, so it uses the current certificates.
+func (c *httpClient) Connect() error {
+	b := c.b
+	b.connecting(b.hosts[0])
+	if err := b.probe(b.hosts[0]); err != nil {
+		return err
+	}
+	transport := &http.Transport{
+		DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+			return b.dial(addr, connectTimeout)
+		},
+		TLSClientConfig:     b.tlsConfig(),
+		TLSHandshakeTimeout: connectTimeout,
+	}
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.client = &http.Client{Transport: transport, Timeout: publishTimeout}
+	c.open = true
+	c.failures = 0
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.sender.Add(1)
+	go c.run(c.ctx)
+	c.mu.Unlock()
+	b.connected()
+	return nil
+}
+
+// Publish queues the message and waits until it is sent. QoS and retain
+// are not supported.
+func (c *httpClient) Publish(topic string, payload []byte, _ byte, _ bool, o messages.Options) error {
+	res := make(chan error, 1)
+	if err := c.Enqueue(topic, payload, o, func(err error) { res <- err }); err != nil {
+		return err
+	}
+	return <-res
+}
+
+// Enqueue queues the message and returns without waiting for the batch
+// to fill. Publishers wait only while the queue is full.
+func (c *httpClient) Enqueue(topic string, payload []byte, o messages.Options, done func(error)) error {
+	m := httpMessage{
+		Topic:       topic,
+		Payload:     payload,
+		ContentType: o.ContentType,
+		Properties:  o.Properties,
+	}
+	if !o.Created.IsZero() {
+		m.Created = &o.Created
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.open && len(c.queue) >= c.capacity {
+		c.changed.Wait()
+	}
+	if !c.open {
+		return errNotConnected
+	}
+	c.queue = append(c.queue, &pending{msg: m, queued: time.Now(), done: done})
+	c.signal()
+	return nil
+}
+
+// Flush sends the queued messages without waiting for the batches to fill.
+func (c *httpClient) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) > 0 {
+		c.flushing = true
+		c.signal()
+	}
+}
+
+// Drain flushes the queue and waits until the queued messages are sent,
+// the client is disconnected or ctx is done.
+func (c *httpClient) Drain(ctx context.Context) {
+	c.Flush()
+	idle := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		for c.open && (len(c.queue) > 0 || c.sending) {
+			c.changed.Wait()
+		}
+		c.mu.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
+func (c *httpClient) Subscribe(string, byte) error {
+	return errHTTPImport
+}
+
+func (c *httpClient) Unsubscribe(string) error {
+	return errHTTPImport
+}
+
+func (c *httpClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open
+}
+
+// Disconnect fails the queued messages, cancels the request in progress
+// and waits for the sender to stop.
+func (c *httpClient) Disconnect() {
+	c.mu.Lock()
+	queue := c.take()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.open = false
+	client := c.client
+	c.client = nil
+	c.mu.Unlock()
+	for _, p := range queue {
+		p.done(errNotConnected)
+	}
+	c.sender.Wait()
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+// take empties the queue and returns the messages it held.
+// It must be called with c.mu held.
+func (c *httpClient) take() []*pending {
+	queue := c.queue
+	c.queue = nil
+	c.flushing = false
+	c.changed.Broadcast()
+	return queue
+}
+
+// signal wakes the sender. It must be called with c.mu held.
+func (c *httpClient) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued messages until ctx is canceled. Batch is sent once it
+// fills, the interval of its first message passes or the queue is flushed.
+func (c *httpClient) run(ctx context.Context) {
+	defer c.sender.Done()
+	for {
+		batch, wait := c.next()
+		if len(batch) > 0 {
+			c.send(ctx, batch)
+			c.mu.Lock()
+			c.sending = false
+			c.changed.Broadcast()
+			c.mu.Unlock()
+			continue
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next takes the batch that is ready to be sent from the queue. Otherwise,
+// it returns how long the first message waits for its batch to fill, which
+// is zero if the queue is empty.
+func (c *httpClient) next() ([]*pending, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		c.flushing = false
+		return nil, 0
+	}
+	wait := time.Until(c.queue[0].queued.Add(c.interval))
+	if len(c.queue) < c.size && !c.flushing && wait > 0 {
+		return nil, wait
+	}
+	n := len(c.queue)
+	if n > c.size {
+		n = c.size
+	}
+	batch := c.queue[:n:n]
+	c.queue = c.queue[n:]
+	c.sending = true
+	c.changed.Broadcast()
+	return batch, 0
+}
+
+// send sends the batch. If the endpoint rejects it, messages of the batch
+// are sent one by one, so only the rejected ones fail. Client is not
+// disconnected because of them, since they are rejected again on replay.
+// Otherwise, failed messages are handed back before the client is
+// disconnected, so they are stored ahead of the queued ones.
+func (c *httpClient) send(ctx context.Context, batch []*pending) {
+	msgs := make([]httpMessage, len(batch))
+	for i, p := range batch {
+		msgs[i] = p.msg
+	}
+	body, err := json.Marshal(msgs)
+	if err == nil {
+		err = c.post(ctx, body)
+	}
+	if len(batch) > 1 && errors.Contains(err, errHTTPRejected) {
+		for _, p := range batch {
+			c.send(ctx, []*pending{p})
+		}
+		return
+	}
+	failed := err != nil && !errors.Contains(err, errHTTPRejected)
+	if !failed {
+		c.mu.Lock()
+		c.failures = 0
+		c.mu.Unlock()
+	}
+	for _, p := range batch {
+		p.done(err)
+	}
+	if failed {
+		c.fail(err)
+	}
+}
+
+// post sends the request, retrying it with backoff if it fails
+// because of the connection, server error or rate limiting.
+func (c *httpClient) post(ctx context.Context, body []byte) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return errNotConnected
+	}
+	for attempt := 1; ; attempt++ {
+		retry, err := c.request(ctx, client, body)
+		if err == nil || !retry || attempt > c.conf.Retries {
+			return err
+		}
+		c.b.logger.Debug(fmt.Sprintf("Request to broker %s failed, retrying in %s: %s", c.b.name, backoff(attempt), err))
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		case <-c.b.done:
+			return err
+		}
+	}
+}
+
+// request sends the request once and reports if it can be retried. Client
+// errors other than timeout and rate limiting mean that the endpoint rejected
+// the messages, so they are not retried.
+func (c *httpClient) request(ctx context.Context, client *http.Client, body []byte) (bool, error) {
+	conf := c.conf
+	req, err := http.NewRequestWithContext(ctx, c.method, c.b.hosts[0], bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range conf.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+conf.BearerToken)
+	case conf.Username != "":
+		req.SetBasicAuth(conf.Username, conf.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	status := errors.New(resp.Status)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return true, errors.Wrap(errHTTPStatus, status)
+	case resp.StatusCode >= 400:
+		return false, errors.Wrap(errHTTPRejected, status)
+	default:
+		return false, errors.Wrap(errHTTPStatus, status)
+	}
+}
+
+// fail disconnects the client, so the queued messages and the ones published
+// meanwhile are stored in the streams, and connects it again after backoff,
+// which republishes them.
+func (c *httpClient) fail(err error) {
+	c.mu.Lock()
+	if !c.open {
+		c.mu.Unlock()
+		return
+	}
+	c.open = false
+	c.failures++
+	queue := c.take()
+	d, ctx := backoff(c.failures), c.ctx
+	c.mu.Unlock()
+	for _, p := range queue {
+		p.done(errNotConnected)
+	}
+	c.b.lost(err)
+	c.b.reconnecting()
+	go func() {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		case <-c.b.done:
+			return
+		}
+		c.mu.Lock()
+		if c.ctx != ctx {
+			c.mu.Unlock()
+			return
+		}
+		c.open = true
+		c.mu.Unlock()
+		c.b.connecting(c.b.hosts[0])
+		c.b.connected()
+	}()
+}
+
+// isHTTP checks if the broker is HTTP endpoint from the http section.
+func isHTTP(cfg config.MQTT) bool {
+	return cfg.HTTP != nil
+}
+
+func isHTTPScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// httpBroker returns the broker configuration of the HTTP endpoint, so routes
+// send messages to it, and buffer them while it is unreachable, the same way
+// as with MQTT brokers.
+func httpBroker(h config.HTTP) (config.MQTT, error) {
+	if err := validateHTTP(h); err != nil {
+		return config.MQTT{}, err
+	}
+	return config.MQTT{
+		Name:              h.Name,
+		Host:              h.URL,
+		Username:          h.Username,
+		Password:          h.Password,
+		Proxy:             h.Proxy,
+		TLSMode:           h.TLSMode,
+		SkipTLSVer:        h.SkipTLSVer,
+		ServerName:        h.ServerName,
+		CAPath:            h.CAPath,
+		ClientCertPath:    h.ClientCertPath,
+		ClientPrivKeyPath: h.ClientPrivKeyPath,
+		// Hop trail is not carried by HTTP requests.
+		HopTrail: config.HopTrailOff,
+		HTTP:     &h,
+	}, nil
+}
+
+// validateHTTP checks the options of the HTTP endpoint.
+func validateHTTP(h config.HTTP) error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	if !isHTTPScheme(u.Scheme) {
+		return errors.Wrap(errUnsupportedScheme, errors.New(u.Scheme))
+	}
+	switch h.Method {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("unsupported HTTP method %s", h.Method)
+	}
+	if h.BatchSize < 0 {
+		return fmt.Errorf("negative batch size %d", h.BatchSize)
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("negative number of retries %d", h.Retries)
+	}
+	if h.BatchInterval != "" {
+		if d, err := time.ParseDuration(h.BatchInterval); err != nil || d < 0 {
+			return fmt.Errorf("bad batch interval %s", h.BatchInterval)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// endpoint records the requests and responds with the statuses in order,
+// repeating the last one.
+type endpoint struct {
+	mu       sync.Mutex
+	statuses []int
+	// reject is the payload the endpoint rejects with 400.
+	reject   string
+	requests []*http.Request
+	batches  [][]httpMessage
+}
+
+func (ep *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch []httpMessage
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.requests = append(ep.requests, r)
+	ep.batches = append(ep.batches, batch)
+	for _, m := range batch {
+		if ep.reject != "" && string(m.Payload) == ep.reject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	status := http.StatusOK
+	if n := len(ep.requests); len(ep.statuses) > 0 {
+		status = ep.statuses[len(ep.statuses)-1]
+		if n <= len(ep.statuses) {
+			status = ep.statuses[n-1]
+		}
+	}
+	w.WriteHeader(status)
+}
+
+// sizes returns the sorted sizes of the batches received.
+func (ep *endpoint) sizes() []int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ret := []int{}
+	for _, b := range ep.batches {
+		ret = append(ret, len(b))
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func newTestHTTPClient(t *testing.T, ep *endpoint, h config.HTTP) *httpClient {
+	t.Helper()
+	srv := httptest.NewServer(ep)
+	t.Cleanup(srv.Close)
+	h.Name, h.URL = "ingest", srv.URL
+	cfg, err := httpBroker(h)
+	if err != nil {
+		t.Fatalf("unexpected error creating HTTP endpoint: %s", err)
+	}
+	e := &exporter{logger: logger.NewMock(), done: make(chan struct{})}
+	t.Cleanup(func() { close(e.done) })
+	b := e.newBroker(h.Name, cfg)
+	c := b.client.(*httpClient)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("unexpected error connecting: %s", err)
+	}
+	t.Cleanup(c.Disconnect)
+	return c
+}
+
+// publish publishes the payloads concurrently, like the route workers do.
+func publish(c *httpClient, payloads []string, o messages.Options) []error {
+	errs := make([]error, len(payloads))
+	var wg sync.WaitGroup
+	for i, p := range payloads {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			errs[i] = c.Publish("channels/1/messages", []byte(p), 0, false, o)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// enqueue queues the payloads in order, like the exporter does, flushes
+// the queue if asked and waits for the results of sending them.
+func enqueue(c *httpClient, payloads []string, flush bool) []error {
+	errs := make([]error, len(payloads))
+	var wg sync.WaitGroup
+	for i, p := range payloads {
+		i := i
+		wg.Add(1)
+		done := func(err error) {
+			errs[i] = err
+			wg.Done()
+		}
+		if err := c.Enqueue("channels/1/messages", []byte(p), messages.Options{}, done); err != nil {
+			done(err)
+		}
+	}
+	if flush {
+		c.Flush()
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestHTTPBatching(t *testing.T) {
+	cases := []struct {
+		desc     string
+		conf     config.HTTP
+		flush    bool
+		payloads []string
+		sizes    []int
+	}{
+		{
+			desc:     "no batching",
+			conf:     config.HTTP{},
+			payloads: []string{"a", "b", "c"},
+			sizes:    []int{1, 1, 1},
+		},
+		{
+			desc:     "batch filled",
+			conf:     config.HTTP{BatchSize: 3, BatchInterval: "1h"},
+			payloads: []string{"a", "b", "c"},
+			sizes:    []int{3},
+		},
+		{
+			desc:     "batch sent after interval",
+			conf:     config.HTTP{BatchSize: 10, BatchInterval: "50ms"},
+			payloads: []string{"a", "b"},
+			sizes:    []int{2},
+		},
+		{
+			desc:     "flushed queue sent in batches",
+			conf:     config.HTTP{BatchSize: 2, BatchInterval: "1h"},
+			flush:    true,
+			payloads: []string{"a", "b", "c", "d", "e"},
+			sizes:    []int{1, 2, 2},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ep := &endpoint{}
+			c := newTestHTTPClient(t, ep, tc.conf)
+			for i, err := range enqueue(c, tc.payloads, tc.flush) {
+				if err != nil {
+					t.Errorf("message %d: unexpected error: %s", i, err)
+				}
+			}
+			if got := ep.sizes(); !reflect.DeepEqual(got, tc.sizes) {
+				t.Errorf("expected batches of %v messages, got %v", tc.sizes, got)
+			}
+		})
+	}
+}
+
+func TestHTTPQueue(t *testing.T) {
+	ep := &endpoint{statuses: []int{http.StatusServiceUnavailable}}
+	c := newTestHTTPClient(t, ep, config.HTTP{BatchSize: 2, BatchInterval: "1h"})
+	results := make(chan error, 3)
+	done := func(err error) { results <- err }
+	// Queuing doesn't wait for the batch to fill.
+	if err := c.Enqueue("channels/1/messages", []byte("a"), messages.Options{}, done); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("expected message to wait for the batch, got result %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, p := range []string{"b", "c"} {
+		if err := c.Enqueue("channels/1/messages", []byte(p), messages.Options{}, done); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// Failed batch disconnects the client, which fails the queued message.
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-results:
+			if err == nil {
+				t.Errorf("message %d: expected error, got nil", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d: expected result, got none", i)
+		}
+	}
+	if got, want := ep.sizes(), []int{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected batches of %v messages, got %v", want, got)
+	}
+	if err := c.Enqueue("channels/1/messages", []byte("d"), messages.Options{}, done); !errors.Contains(err, errNotConnected) {
+		t.Errorf("expected error %s, got %v", errNotConnected, err)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	cases := []struct {
+		desc      string
+		statuses  []int
+		retries   int
+		err       error
+		requests  int
+		connected bool
+	}{
+		{
+			desc:      "accepted",
+			statuses:  []int{http.StatusAccepted},
+			requests:  1,
+			connected: true,
+		},
+		{
+			desc:      "server error retried",
+			statuses:  []int{http.StatusInternalServerError, http.StatusOK},
+			retries:   1,
+			requests:  2,
+			connected: true,
+		},
+		{
+			desc:      "rate limiting retried",
+			statuses:  []int{http.StatusTooManyRequests, http.StatusOK},
+			retries:   1,
+			requests:  2,
+			connected: true,
+		},
+		{
+			desc:      "server error without retries",
+			statuses:  []int{http.StatusServiceUnavailable},
+			err:       errHTTPStatus,
+			requests:  1,
+			connected: false,
+		},
+		{
+			desc:      "bad request not retried",
+			statuses:  []int{http.StatusBadRequest},
+			retries:   3,
+			err:       errHTTPRejected,
+			requests:  1,
+			connected: true,
+		},
+		{
+			desc:      "unprocessable entity not retried",
+			statuses:  []int{http.StatusUnprocessableEntity},
+			retries:   3,
+			err:       errHTTPRejected,
+			requests:  1,
+			connected: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ep := &endpoint{statuses: tc.statuses}
+			c := newTestHTTPClient(t, ep, config.HTTP{Retries: tc.retries})
+			err := publish(c, []string{"a"}, messages.Options{})[0]
+			switch {
+			case tc.err == nil && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Errorf("expected error %s, got %v", tc.err, err)
+			}
+			if n := len(ep.sizes()); n != tc.requests {
+				t.Errorf("expected %d requests, got %d", tc.requests, n)
+			}
+			if open := c.IsConnectionOpen(); open != tc.connected {
+				t.Errorf("expected connected %t, got %t", tc.connected, open)
+			}
+		})
+	}
+}
+
+func TestHTTPRejectedBatch(t *testing.T) {
+	ep := &endpoint{reject: "bad"}
+	c := newTestHTTPClient(t, ep, config.HTTP{BatchSize: 3, BatchInterval: "1h"})
+	payloads := []string{"a", "bad", "c"}
+	errs := publish(c, payloads, messages.Options{})
+	for i, err := range errs {
+		switch rejected := payloads[i] == "bad"; {
+		case rejected && !errors.Contains(err, errHTTPRejected):
+			t.Errorf("message %s: expected error %s, got %v", payloads[i], errHTTPRejected, err)
+		case !rejected && err != nil:
+			t.Errorf("message %s: unexpected error: %s", payloads[i], err)
+		}
+	}
+	// Rejected batch is sent again one message at a time.
+	if got, want := ep.sizes(), []int{1, 1, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected batches of %v messages, got %v", want, got)
+	}
+	if !c.IsConnectionOpen() {
+		t.Errorf("expected client to stay connected")
+	}
+}
+
+func TestHTTPRequest(t *testing.T) {
+	cases := []struct {
+		desc    string
+		conf    config.HTTP
+		method  string
+		headers map[string]string
+	}{
+		{
+			desc:    "defaults",
+			method:  http.MethodPost,
+			headers: map[string]string{"Content-Type": "application/json", "Authorization": ""},
+		},
+		{
+			desc:    "bearer token",
+			conf:    config.HTTP{BearerToken: "token", Username: "user", Password: "pass"},
+			method:  http.MethodPost,
+			headers: map[string]string{"Authorization": "Bearer token"},
+		},
+		{
+			desc:    "basic authentication",
+			conf:    config.HTTP{Username: "user", Password: "pass"},
+			method:  http.MethodPost,
+			headers: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+		},
+		{
+			desc:    "method and headers",
+			conf:    config.HTTP{Method: http.MethodPut, Headers: map[string]string{"X-Tenant": "tenant"}},
+			method:  http.MethodPut,
+			headers: map[string]string{"X-Tenant": "tenant"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ep := &endpoint{}
+			c := newTestHTTPClient(t, ep, tc.conf)
+			created := time.Unix(1690000000, 0).UTC()
+			o := messages.Options{Created: created, ContentType: "application/senml+json"}
+			if err := publish(c, []string{"a"}, o)[0]; err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			req := ep.requests[0]
+			if req.Method != tc.method {
+				t.Errorf("expected method %s, got %s", tc.method, req.Method)
+			}
+			for k, v := range tc.headers {
+				if got := req.Header.Get(k); got != v {
+					t.Errorf("expected header %s %q, got %q", k, v, got)
+				}
+			}
+			want := httpMessage{Topic: "channels/1/messages", Payload: []byte("a"), Created: &created, ContentType: "application/senml+json"}
+			if got := ep.batches[0][0]; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected message %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestHTTPReplay(t *testing.T) {
+	ep := &endpoint{reject: "bad"}
+	c := newTestHTTPClient(t, ep, config.HTTP{BatchSize: 3, BatchInterval: "1h"})
+	e := newTestDeadLetters(t, nil)
+	e.replay, e.buffered = make(chan struct{}, 1), make(map[string]bool)
+	stream := streamPrefix + ".webhook"
+	e.brokers["ingest"], e.streams = c.b, map[string]string{stream: "ingest"}
+
+	src, err := proto.Marshal(testMessage("raw"))
+	if err != nil {
+		t.Fatalf("unexpected error encoding message: %s", err)
+	}
+	for _, p := range []string{"a", "b", "bad", "d"} {
+		o := messages.Options{Source: src}
+		if err := e.store(stream, "channels/1/messages", []byte(p), o); err != nil {
+			t.Fatalf("unexpected error storing message: %s", err)
+		}
+	}
+	if err := e.drain(stream); err != nil {
+		t.Fatalf("unexpected error republishing messages: %s", err)
+	}
+	// Replayed messages fill the batches, rejected batch is sent one by one.
+	if got, want := ep.sizes(), []int{1, 1, 1, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected batches of %v messages, got %v", want, got)
+	}
+	if n, err := e.cache.Len(stream); err != nil || n != 0 {
+		t.Errorf("expected stream drained, got %d messages: %v", n, err)
+	}
+	// Rejected message is dead-lettered as the route received it.
+	dls, err := e.ListDeadLetters(10)
+	if err != nil {
+		t.Fatalf("unexpected error listing dead letters: %s", err)
+	}
+	if len(dls) != 1 || dls[0].Route != "webhook" || string(dls[0].Payload) != "raw" {
+		t.Errorf("expected dead letter of route webhook with payload raw, got %+v", dls)
+	}
+}
+
+func TestCheckHTTPRoute(t *testing.T) {
+	cases := []struct {
+		desc   string
+		target string
+		err    error
+	}{
+		{
+			desc:   "selected as target",
+			target: "ingest",
+		},
+		{
+			desc: "selected as broker",
+			err:  errBrokerType,
+		},
+	}
+	cfg, err := httpBroker(config.HTTP{Name: "ingest", URL: "https://ingest.example.com", BatchSize: 10})
+	if err != nil {
+		t.Fatalf("unexpected error creating HTTP endpoint: %s", err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rc := config.Route{Name: "webhook", NatsTopic: "channels", MqttTopic: "channels", Type: mainfluxType, Target: tc.target}
+			if tc.target == "" {
+				rc.Broker = "ingest"
+			}
+			err := checkBroker(NewRoute(rc, logger.NewMock(), nil), cfg)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Errorf("expected error %s, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+// imports returns QoS by topic filter of the import routes of the broker.
+// QoS of the route is used if set, QoS of the broker otherwise.
+func (e *exporter) imports(broker string) map[string]byte {
+	e.RLock()
+	defer e.RUnlock()
+	filters := make(map[string]byte)
+	b, ok := e.brokers[broker]
+	if !ok {
+		return filters
+	}
+	for _, r := range e.consumers {
+		if r.Direction != config.DirectionImport || r.Broker != broker {
+			continue
+		}
+		qos := byte(b.cfg.QoS)
+		if r.QoS != nil {
+			qos = *r.QoS
+		}
+		if q, ok := filters[r.MqttTopic]; !ok || qos > q {
+			filters[r.MqttTopic] = qos
+		}
+	}
+	return filters
+}
+
+// received passes the message received from the broker to the import
+// routes whose topic filter matches the topic. Hop trail of the message,
+// including the exporter itself, is kept, so the message is not exported
+// by the exporter again and its trail is continued by the others.
+func (e *exporter) received(b *broker, topic string, payload []byte, props map[string]string) {
+	e.RLock()
+	var routes []*Route
+	for _, r := range e.consumers {
+		if r.Direction == config.DirectionImport && r.Broker == b.name && match(r.MqttTopic, topic) {
+			routes = append(routes, r)
+		}
+	}
+	e.RUnlock()
+	hops, payload := b.trail(payload, props)
+	for _, r := range routes {
+		if e.suppressed(r, hops, false) {
+			continue
+		}
+		msg, err := r.inbound(topic, payload, props, b.clientID())
+		if err != nil {
+			failedMessages.WithLabelValues(routeLabel(r.Stream)).Inc()
+			e.logger.Warn(fmt.Sprintf("Failed to import message on route %s: %s", r.Name, err))
+			continue
+		}
+		e.trails.add(msg, append(hops[:len(hops):len(hops)], e.instanceID))
+		if err := r.Handle(msg); err != nil && err != errRouteClosed {
+			e.logger.Error(fmt.Sprintf("Failed to import message on route %s: %s", r.Name, err))
+		}
+	}
+}
+
+// forward publishes the message of the import route to the message bus.
+func (e *exporter) forward(r *Route, msg *messaging.Message) error {
+	route := routeLabel(r.Stream)
+	if err := e.pubsub.Publish(context.Background(), msg.Channel, msg); err != nil {
+		failedMessages.WithLabelValues(route).Inc()
+		return err
+	}
+	publishedMessages.WithLabelValues(route).Inc()
+	return nil
+}
+
+// subscribeBroker subscribes the broker of the import route to its topic filter.
+func (e *exporter) subscribeBroker(r *Route) {
+	e.RLock()
+	b, ok := e.brokers[r.Broker]
+	e.RUnlock()
+	if !ok {
+		return
+	}
+	if qos, ok := e.imports(r.Broker)[r.MqttTopic]; ok {
+		b.subscribe(r.MqttTopic, qos)
+	}
+}
+
+// unsubscribeBroker unsubscribes the broker of the import route from
+// its topic filter, unless the filter is used by other import routes.
+func (e *exporter) unsubscribeBroker(r *Route) {
+	e.RLock()
+	b, ok := e.brokers[r.Broker]
+	for _, o := range e.consumers {
+		if o != r && o.Direction == config.DirectionImport && o.Broker == r.Broker && o.MqttTopic == r.MqttTopic {
+			ok = false
+		}
+	}
+	e.RUnlock()
+	if ok {
+		b.unsubscribe(r.MqttTopic)
+	}
+}
+
+// match checks if the topic matches the MQTT topic filter.
+func match(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	// Wildcards don't match topics starting with $, i.e. $SYS.
+	if strings.HasPrefix(topic, "$") && (fs[0] == "+" || fs[0] == "#") {
+		return false
+	}
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// validFilter checks if the MQTT topic filter is valid.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "export"
+
+var (
+	receivedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Number of messages received from the message bus.",
+	}, []string{"route"})
+	publishedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Number of messages published to MQTT broker, including replayed ones.",
+	}, []string{"route"})
+	failedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_total",
+		Help:      "Number of failed attempts to publish a message to MQTT broker.",
+	}, []string{"route"})
+	bufferedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_buffered_total",
+		Help:      "Number of messages stored in the route stream.",
+	}, []string{"route"})
+	replayedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_replayed_total",
+		Help:      "Number of messages republished from the route stream.",
+	}, []string{"route"})
+	droppedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dropped_total",
+		Help:      "Number of buffered messages dropped by the retention policy.",
+	}, []string{"route", "reason"})
+
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dead_lettered_total",
+		Help:      "Number of messages route failed to process.",
+	}, []string{"route"})
+
+	suppressedLoops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "loops_suppressed_total",
+		Help:      "Number of messages not published because they already passed through the exporter or reached the hop limit.",
+	}, []string{"route", "reason"})
+
+	publishLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_latency_seconds",
+		Help:      "Time it takes MQTT broker to acknowledge the message.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"route"})
+	payloadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "payload_size_bytes",
+		Help:      "Size of the payload published to MQTT broker.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"route"})
+	lag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lag_seconds",
+		Help:      "Time from the message creation until it is published to MQTT broker.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+	}, []string{"route"})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of messages waiting for the route workers.",
+	}, []string{"route"})
+	connectionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connection_state",
+		Help:      "Set to 1 for the current state of the connection and 0 for the others.",
+	}, []string{"connection", "state"})
+	activeHost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "broker_active_host",
+		Help:      "Set to 1 for the host the broker client is connected to and 0 for the others.",
+	}, []string{"broker", "host"})
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "broker_failovers_total",
+		Help:      "Number of connections to the host other than the preferred one.",
+	}, []string{"broker"})
+	certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "client_certificate_expiry_timestamp_seconds",
+		Help:      "Unix time when the client certificate of the broker expires.",
+	}, []string{"broker"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		receivedMessages,
+		publishedMessages,
+		failedMessages,
+		bufferedMessages,
+		replayedMessages,
+		droppedMessages,
+		deadLetters,
+		suppressedLoops,
+		publishLatency,
+		payloadSize,
+		lag,
+		queueDepth,
+		connectionState,
+		activeHost,
+		failovers,
+		certificateExpiry,
+	)
+}
+
+// routeLabel returns the route label of the metrics for the route stream.
+func routeLabel(stream string) string {
+	return strings.TrimPrefix(stream, streamPrefix+".")
+}
+
+// deleteRouteMetrics deletes the metrics of the route that was removed.
+func deleteRouteMetrics(route string) {
+	for _, c := range []*prometheus.CounterVec{receivedMessages, publishedMessages, failedMessages, bufferedMessages, replayedMessages, deadLetters} {
+		c.DeleteLabelValues(route)
+	}
+	for _, h := range []*prometheus.HistogramVec{publishLatency, payloadSize, lag} {
+		h.DeleteLabelValues(route)
+	}
+	queueDepth.DeleteLabelValues(route)
+	droppedMessages.DeletePartialMatch(prometheus.Labels{"route": route})
+	suppressedLoops.DeletePartialMatch(prometheus.Labels{"route": route})
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mainflux/export/pkg/messages"
+)
+
+var _ mqttClient = (*mqtt3Client)(nil)
+
+// mqtt3Client publishes messages over MQTT 3.1.1. Content type,
+// expiry and properties of the messages are not supported.
+type mqtt3Client struct {
+	b      *broker
+	client mqtt.Client
+}
+
+func newMQTT3Client(b *broker) *mqtt3Client {
+	conf := b.cfg
+	opts := mqtt.NewClientOptions().
+		SetClientID(b.clientID()).
+		SetCleanSession(!conf.PersistentSession).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			b.connected()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			b.lost(err)
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, opts *mqtt.ClientOptions) {
+			b.reconnecting()
+			// Reordered servers are used for the reconnect attempt.
+			opts.Servers = b.order(opts.Servers)
+		}).
+		SetConnectionAttemptHandler(func(host *url.URL, cfg *tls.Config) *tls.Config {
+			b.connecting(host.String())
+			return cfg
+		}).
+		SetCustomOpenConnectionFn(func(host *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			return b.open(host)
+		})
+	for _, h := range b.hosts {
+		opts.AddBroker(h)
+	}
+
+	if conf.Username != "" && conf.Password != "" {
+		opts.SetUsername(conf.Username)
+		opts.SetPassword(conf.Password)
+	}
+
+	if cfg := b.tlsConfig(); cfg != nil {
+		opts.SetTLSConfig(cfg)
+		opts.SetProtocolVersion(mqtt311)
+	}
+	if conf.ProtocolVersion != 0 {
+		opts.SetProtocolVersion(uint(conf.ProtocolVersion))
+	}
+	if m := b.will; m != nil {
+		opts.SetBinaryWill(m.topic, m.payload, m.qos, m.retain)
+	}
+	if conf.StoreDir != "" {
+		// Brokers can share the directory, so each of them uses its own store.
+		dir := filepath.Join(conf.StoreDir, b.name)
+		// File store panics if it can't create the directory.
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			b.logger.Error(fmt.Sprintf("Failed to create store of broker %s, messages in flight are kept in memory: %s", b.name, err))
+		} else {
+			opts.SetStore(mqtt.NewFileStore(dir))
+		}
+	}
+	return &mqtt3Client{b: b, client: mqtt.NewClient(opts)}
+}
+
+func (c *mqtt3Client) Connect() error {
+	token := c.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (c *mqtt3Client) Publish(topic string, payload []byte, qos byte, retain bool, _ messages.Options) error {
+	// Client accepts QoS 0 messages while reconnecting and drops them silently.
+	if !c.client.IsConnectionOpen() {
+		return errNotConnected
+	}
+	token := c.client.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (c *mqtt3Client) Subscribe(filter string, qos byte) error {
+	token := c.client.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		c.b.received(m.Topic(), m.Payload(), nil)
+	})
+	if !token.WaitTimeout(publishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (c *mqtt3Client) Unsubscribe(filter string) error {
+	token := c.client.Unsubscribe(filter)
+	if !token.WaitTimeout(publishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (c *mqtt3Client) IsConnectionOpen() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqtt3Client) Disconnect() {
+	c.client.Disconnect(disconnectQuiesce)
+}
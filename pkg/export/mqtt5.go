@@ -0,0 +1,314 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	keepAlive      = 30
+	// Broker keeps the persistent session for sessionExpiry after client disconnects.
+	sessionExpiry = 7 * 24 * time.Hour
+)
+
+var errClientClosed = errors.New("MQTT client closed while connecting")
+
+var _ mqttClient = (*mqtt5Client)(nil)
+
+// mqtt5Client publishes messages over MQTT 5. Client reconnects with backoff
+// once the connection is lost, trying the hosts in the broker order.
+type mqtt5Client struct {
+	b     *broker
+	hosts []*url.URL
+	mu    sync.Mutex
+	// Session is changed on every Connect and Disconnect,
+	// which stops reconnecting of the previous session.
+	session int
+	client  *paho.Client
+	// Topic aliases are valid only for the connection they are sent on.
+	aliases  map[string]*topicAlias
+	aliasMax uint16
+}
+
+// topicAlias is the alias of the topic. Alias replaces the topic
+// once the message with both the topic and the alias is sent.
+type topicAlias struct {
+	id    uint16
+	ready bool
+}
+
+func newMQTT5Client(b *broker) *mqtt5Client {
+	c := &mqtt5Client{b: b}
+	for _, h := range b.hosts {
+		// Hosts are validated by brokerConfigs.
+		if u, err := url.Parse(h); err == nil {
+			c.hosts = append(c.hosts, u)
+		}
+	}
+	return c
+}
+
+func (c *mqtt5Client) Connect() error {
+	c.mu.Lock()
+	c.session++
+	session := c.session
+	c.mu.Unlock()
+	return c.dial(session)
+}
+
+// dial tries to connect to the hosts one by one.
+func (c *mqtt5Client) dial(session int) error {
+	var err error
+	for _, u := range c.b.order(c.hosts) {
+		c.b.connecting(u.String())
+		if err = c.connect(u, session); err == nil {
+			c.b.connected()
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *mqtt5Client) connect(u *url.URL, session int) error {
+	conn, err := c.b.open(u)
+	if err != nil {
+		return err
+	}
+	var client *paho.Client
+	client = paho.NewClient(paho.ClientConfig{
+		Conn: conn,
+		OnClientError: func(err error) {
+			c.lost(client, err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.lost(client, fmt.Errorf("disconnected by server with reason code %d", d.ReasonCode))
+		},
+		Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+			var props map[string]string
+			if p.Properties != nil && len(p.Properties.User) > 0 {
+				props = make(map[string]string, len(p.Properties.User))
+				for _, u := range p.Properties.User {
+					props[u.Key] = u.Value
+				}
+			}
+			c.b.received(p.Topic, p.Payload, props)
+		}),
+	})
+	cp := &paho.Connect{
+		ClientID:   c.b.clientID(),
+		KeepAlive:  keepAlive,
+		CleanStart: !c.b.cfg.PersistentSession,
+	}
+	if c.b.cfg.PersistentSession {
+		expiry := uint32(sessionExpiry.Seconds())
+		cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+	}
+	if m := c.b.will; m != nil {
+		cp.WillMessage = &paho.WillMessage{
+			Topic:   m.topic,
+			Payload: m.payload,
+			QoS:     m.qos,
+			Retain:  m.retain,
+		}
+	}
+	if conf := c.b.cfg; conf.Username != "" && conf.Password != "" {
+		cp.Username = conf.Username
+		cp.UsernameFlag = true
+		cp.Password = []byte(conf.Password)
+		cp.PasswordFlag = true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.session != session {
+		c.mu.Unlock()
+		// Disconnect waits for the client handlers, which need the lock.
+		client.Disconnect(&paho.Disconnect{})
+		return errClientClosed
+	}
+	defer c.mu.Unlock()
+	c.client = client
+	c.aliases = make(map[string]*topicAlias)
+	c.aliasMax = 0
+	if ca.Properties != nil && ca.Properties.TopicAliasMaximum != nil {
+		c.aliasMax = *ca.Properties.TopicAliasMaximum
+	}
+	return nil
+}
+
+// lost starts reconnecting unless the client is no longer used.
+func (c *mqtt5Client) lost(client *paho.Client, err error) {
+	c.mu.Lock()
+	if c.client == nil || c.client != client {
+		c.mu.Unlock()
+		return
+	}
+	c.client = nil
+	session := c.session
+	c.mu.Unlock()
+	client.Conn.Close()
+	c.b.lost(err)
+	go c.reconnect(session)
+}
+
+func (c *mqtt5Client) reconnect(session int) {
+	for attempt := 1; ; attempt++ {
+		c.mu.Lock()
+		current := c.session == session
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+		c.b.reconnecting()
+		err := c.dial(session)
+		if err == nil {
+			return
+		}
+		d := backoff(attempt)
+		c.b.logger.Warn(fmt.Sprintf("Client %s failed to reconnect to broker %s: %s, retrying in %s", c.b.clientID(), c.b.name, err, d))
+		select {
+		case <-time.After(d):
+		case <-c.b.stop:
+			return
+		case <-c.b.done:
+			return
+		}
+	}
+}
+
+func (c *mqtt5Client) Publish(topic string, payload []byte, qos byte, retain bool, o messages.Options) error {
+	c.mu.Lock()
+	client := c.client
+	alias := c.alias(topic)
+	var id uint16
+	var ready bool
+	if alias != nil {
+		id, ready = alias.id, alias.ready
+	}
+	c.mu.Unlock()
+	if client == nil {
+		return errNotConnected
+	}
+
+	p := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ContentType: o.ContentType,
+		},
+	}
+	if o.Expiry > 0 {
+		expiry := uint32(math.Ceil(o.Expiry.Seconds()))
+		p.Properties.MessageExpiry = &expiry
+	}
+	keys := make([]string, 0, len(o.Properties))
+	for k := range o.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.Properties.User.Add(k, o.Properties[k])
+	}
+	if alias != nil {
+		p.Properties.TopicAlias = &id
+		if ready {
+			p.Topic = ""
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if _, err := client.Publish(ctx, p); err != nil {
+		return err
+	}
+	if alias != nil && !ready {
+		c.mu.Lock()
+		if c.client == client {
+			alias.ready = true
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// alias returns the alias of the topic, or nil once all the aliases
+// the broker accepts are used. Must be called with lock held.
+func (c *mqtt5Client) alias(topic string) *topicAlias {
+	if c.client == nil {
+		return nil
+	}
+	if a, ok := c.aliases[topic]; ok {
+		return a
+	}
+	if len(c.aliases) >= int(c.aliasMax) {
+		return nil
+	}
+	a := &topicAlias{id: uint16(len(c.aliases) + 1)}
+	c.aliases[topic] = a
+	return a
+}
+
+func (c *mqtt5Client) Subscribe(filter string, qos byte) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return errNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err := client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{filter: {QoS: qos}},
+	})
+	return err
+}
+
+func (c *mqtt5Client) Unsubscribe(filter string) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return errNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err := client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+	return err
+}
+
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil
+}
+
+func (c *mqtt5Client) Disconnect() {
+	c.mu.Lock()
+	c.session++
+	client := c.client
+	c.client = nil
+	c.mu.Unlock()
+	if client != nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const natsScheme = "nats"
+
+var (
+	errNATSImport = errors.New("import routes are not supported by NATS servers")
+	errNATSHosts  = errors.New("NATS servers are configured in the nats section")
+	errNATSOption = errors.New("route option is supported only by nats routes")
+	errMQTTRoute  = errors.New("route option is not supported by nats routes")
+	errNATSRoute  = errors.New("nats route option is not set")
+	errTarget     = errors.New("route can't set both broker and target")
+	errBadTarget  = errors.New("Bad NATS target")
+	errBrokerType = errors.New("Route type doesn't match the broker")
+)
+
+var _ mqttClient = (*natsClient)(nil)
+
+// natsClient publishes messages of nats routes to the other NATS server,
+// so they are buffered and replayed the same way as MQTT messages.
+// Topics of the messages are NATS subjects.
+type natsClient struct {
+	b    *broker
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+func newNATSClient(b *broker) *natsClient {
+	return &natsClient{b: b}
+}
+
+func (c *natsClient) Connect() error {
+	b, conf := c.b, c.b.cfg
+	opts := []nats.Option{
+		nats.Name(b.clientID()),
+		nats.MaxReconnects(-1),
+		// Messages published while reconnecting fail and are buffered
+		// by the exporter instead of the client.
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if nc.IsClosed() {
+				return
+			}
+			b.lost(err)
+			b.reconnecting()
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			b.connecting(nc.ConnectedUrl())
+			b.connected()
+		}),
+	}
+	if b.policy == failover {
+		opts = append(opts, nats.DontRandomize())
+	}
+	if conf.Username != "" && conf.Password != "" {
+		opts = append(opts, nats.UserInfo(conf.Username, conf.Password))
+	}
+	if cfg := b.tlsConfig(); cfg != nil {
+		opts = append(opts, nats.Secure(cfg))
+	}
+	b.connecting(b.hosts[0])
+	nc, err := nats.Connect(strings.Join(b.hosts, ","), opts...)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.conn = nc
+	c.mu.Unlock()
+	b.connecting(nc.ConnectedUrl())
+	b.connected()
+	return nil
+}
+
+// Publish publishes the message to the subject. QoS above 0 waits
+// for the server to receive the message. Retain is not supported.
+func (c *natsClient) Publish(topic string, payload []byte, qos byte, _ bool, _ messages.Options) error {
+	nc := c.get()
+	if nc == nil || !nc.IsConnected() {
+		return errNotConnected
+	}
+	if err := nc.Publish(topic, payload); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+	if err := nc.FlushTimeout(publishTimeout); err != nil {
+		if err == nats.ErrTimeout {
+			return errPublishTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *natsClient) Subscribe(string, byte) error {
+	return errNATSImport
+}
+
+func (c *natsClient) Unsubscribe(string) error {
+	return errNATSImport
+}
+
+func (c *natsClient) IsConnectionOpen() bool {
+	nc := c.get()
+	return nc != nil && nc.IsConnected()
+}
+
+func (c *natsClient) Disconnect() {
+	c.mu.Lock()
+	nc := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if nc != nil {
+		nc.Close()
+	}
+}
+
+func (c *natsClient) get() *nats.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// checkBroker checks that nats routes publish to NATS servers, the other
+// routes to MQTT brokers or HTTP endpoints, that import routes use MQTT
+// brokers and that targets are selected with target rather than broker.
+func checkBroker(r *Route, cfg config.MQTT) error {
+	target := isNATS(cfg) || isHTTP(cfg)
+	if (r.Type == natsType) != isNATS(cfg) || (r.Direction == config.DirectionImport && target) || (r.conf.Target != "") != target {
+		return errors.Wrap(errBrokerType, errors.New(r.Name))
+	}
+	return nil
+}
+
+// isNATS checks if the broker is NATS server from the nats section.
+func isNATS(cfg config.MQTT) bool {
+	hs := hosts(cfg)
+	if len(hs) == 0 {
+		return false
+	}
+	u, err := url.Parse(hs[0])
+	return err == nil && u.Scheme == natsScheme
+}
+
+// natsBroker returns the broker configuration of the NATS server, so routes
+// publish to it, and buffer the messages while it is unreachable, the same
+// way as with MQTT brokers. Servers without scheme use nats://.
+func natsBroker(n config.NATS) (config.MQTT, error) {
+	var hs []string
+	for _, h := range strings.Split(n.URL, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if !strings.Contains(h, "://") {
+			h = natsScheme + "://" + h
+		}
+		u, err := url.Parse(h)
+		if err != nil {
+			return config.MQTT{}, err
+		}
+		if u.Scheme != natsScheme {
+			return config.MQTT{}, errors.Wrap(errUnsupportedScheme, errors.New(u.Scheme))
+		}
+		hs = append(hs, h)
+	}
+	if len(hs) == 0 {
+		return config.MQTT{}, errors.New("no url")
+	}
+	cfg := config.MQTT{
+		Name:              n.Name,
+		Host:              hs[0],
+		Hosts:             hs[1:],
+		Username:          n.Username,
+		Password:          n.Password,
+		TLSMode:           n.TLSMode,
+		SkipTLSVer:        n.SkipTLSVer,
+		ServerName:        n.ServerName,
+		CAPath:            n.CAPath,
+		ClientCertPath:    n.ClientCertPath,
+		ClientPrivKeyPath: n.ClientPrivKeyPath,
+		// Hop trail is not carried by NATS messages.
+		HopTrail: config.HopTrailOff,
+	}
+	if n.Flush {
+		cfg.QoS = 1
+	}
+	return cfg, nil
+}
+
+// validateTarget checks that nats routes set the target and subject
+// instead of MQTT options, and that the other routes don't set the
+// subject and set at most one of the broker and target.
+func (e *exporter) validateTarget(rc config.Route) error {
+	if rc.Type != natsType {
+		if rc.Target != "" && rc.Broker != "" {
+			return errTarget
+		}
+		return rejectOptions(errNATSOption, option{"nats_subject", rc.NatsSubject != ""})
+	}
+	// Flush of the NATS server is used instead of QoS and the other
+	// options of MQTT messages can't be carried.
+	if err := rejectOptions(errMQTTRoute,
+		option{"broker", rc.Broker != ""},
+		option{"mqtt_topic", rc.MqttTopic != ""},
+		option{"subtopic", rc.SubTopic != ""},
+		option{"qos", rc.QoS != nil},
+		option{"retain", rc.Retain != nil},
+		option{"content_type", rc.ContentType != ""},
+		option{"ttl", rc.TTL != ""},
+	); err != nil {
+		return err
+	}
+	if rc.Target == "" {
+		return errors.Wrap(errNATSRoute, errors.New("target"))
+	}
+	// Channel and subtopic are appended to the subject, so it can't contain wildcards.
+	if !e.validateSubject(rc.NatsSubject) || strings.ContainsAny(rc.NatsSubject, "*>") {
+		return errors.Wrap(errBadSubject, errors.New(rc.NatsSubject))
+	}
+	return nil
+}
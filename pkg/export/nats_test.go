@@ -0,0 +1,82 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"testing"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+func TestValidateTarget(t *testing.T) {
+	qos, retain := 1, true
+	bridge := func(update func(*config.Route)) config.Route {
+		rc := config.Route{Name: "bridge", NatsTopic: Channels, NatsSubject: Channels, Type: natsType, Target: "regional"}
+		update(&rc)
+		return rc
+	}
+	cases := []struct {
+		desc  string
+		route config.Route
+		err   error
+	}{
+		{
+			desc:  "nats route",
+			route: bridge(func(rc *config.Route) {}),
+		},
+		{
+			desc:  "nats route without target",
+			route: bridge(func(rc *config.Route) { rc.Target = "" }),
+			err:   errNATSRoute,
+		},
+		{
+			desc:  "nats route with wildcard subject",
+			route: bridge(func(rc *config.Route) { rc.NatsSubject = "channels.>" }),
+			err:   errBadSubject,
+		},
+		{
+			desc:  "nats route with MQTT topic",
+			route: bridge(func(rc *config.Route) { rc.MqttTopic = Channels }),
+			err:   errMQTTRoute,
+		},
+		{
+			desc:  "nats route with QoS",
+			route: bridge(func(rc *config.Route) { rc.QoS = &qos }),
+			err:   errMQTTRoute,
+		},
+		{
+			desc:  "nats route with retain",
+			route: bridge(func(rc *config.Route) { rc.Retain = &retain }),
+			err:   errMQTTRoute,
+		},
+		{
+			desc:  "nats route with TTL",
+			route: bridge(func(rc *config.Route) { rc.TTL = "1m" }),
+			err:   errMQTTRoute,
+		},
+		{
+			desc:  "MQTT route with subject",
+			route: config.Route{Name: "mqtt", NatsTopic: Channels, MqttTopic: Channels, Type: defaultType, NatsSubject: Channels},
+			err:   errNATSOption,
+		},
+		{
+			desc:  "MQTT route with broker and target",
+			route: config.Route{Name: "mqtt", NatsTopic: Channels, MqttTopic: Channels, Type: defaultType, Broker: "b", Target: "t"},
+			err:   errTarget,
+		},
+	}
+	e := newTestExporter(0, config.MQTT{})
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := e.validateTarget(tc.route)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Errorf("expected error %s, got %v", tc.err, err)
+			}
+		})
+	}
+}
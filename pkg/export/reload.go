@@ -0,0 +1,169 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+var errShuttingDown = errors.New("service is shutting down")
+
+// Reload applies the new configuration. Routes are matched by name.
+// New routes are subscribed, removed ones are unsubscribed and drained and
+// changed ones are replaced, unless only the number of workers changed.
+// Brokers are matched by name and reconnected if their configuration changed.
+func (e *exporter) Reload(c config.Config) error {
+	cfgs, err := brokerConfigs(c)
+	if err != nil {
+		return errors.Wrap(ErrInvalidConfig, err)
+	}
+	routes := make(map[string]*Route)
+	for _, rc := range c.Routes {
+		r, err := e.checkRoute(rc, cfgs)
+		if err != nil {
+			return errors.Wrap(ErrInvalidConfig, err)
+		}
+		if _, ok := routes[r.Name]; ok {
+			return errors.Wrap(ErrInvalidConfig, errors.Wrap(errDuplicateRoute, errors.New(r.Name)))
+		}
+		routes[r.Name] = r
+	}
+	if len(routes) == 0 {
+		return errors.Wrap(ErrInvalidConfig, errNoRoutesConfigured)
+	}
+	if err := checkTrails(routes, cfgs); err != nil {
+		return errors.Wrap(ErrInvalidConfig, err)
+	}
+	if _, err := deadLetterRetention(c.DeadLetter); err != nil {
+		return errors.Wrap(ErrInvalidConfig, err)
+	}
+
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+	select {
+	case <-e.done:
+		return errShuttingDown
+	default:
+	}
+
+	e.RLock()
+	current := e.cfg
+	old := make(map[string]*Route, len(e.consumers))
+	for k, r := range e.consumers {
+		old[k] = r
+	}
+	e.RUnlock()
+
+	if !reflect.DeepEqual(current.Server, c.Server) {
+		e.logger.Warn("Changes of the exp section take effect after restart")
+		c.Server = current.Server
+	}
+	stale := e.updateBrokers(cfgs)
+
+	ctx := context.Background()
+	for k, r := range old {
+		if _, ok := routes[k]; !ok {
+			e.removeRoute(ctx, r)
+		}
+	}
+	for k, r := range routes {
+		o, ok := old[k]
+		switch {
+		case !ok:
+			e.addRoute(ctx, r)
+		case sameRoute(o, r):
+			if o.Workers != r.Workers {
+				e.logger.Info(fmt.Sprintf("Resizing route %s from %d to %d workers", k, o.Workers, r.Workers))
+				o.Resize(r.Workers)
+			}
+			o.conf = r.conf
+		default:
+			e.replaceRoute(ctx, o, r)
+		}
+	}
+
+	// Routes removed or replaced above no longer publish to stale brokers,
+	// apart from the ones still draining, which store messages instead.
+	for _, b := range stale {
+		b.close()
+		b.forget()
+	}
+
+	e.Lock()
+	e.cfg = c
+	e.Unlock()
+	if e.cache != nil && !reflect.DeepEqual(current.DeadLetter, c.DeadLetter) {
+		e.initDeadLetters()
+	}
+	return nil
+}
+
+// sameRoute checks if routes differ only in the number of workers.
+func sameRoute(a, b *Route) bool {
+	ac, bc := a.conf, b.conf
+	ac.Workers, bc.Workers = 0, 0
+	return reflect.DeepEqual(ac, bc)
+}
+
+func (e *exporter) addRoute(ctx context.Context, r *Route) {
+	e.logger.Info(fmt.Sprintf("Adding route %s", r.Name))
+	e.Lock()
+	e.consumers[r.Name] = r
+	e.streams[r.Stream] = r.Broker
+	e.Unlock()
+	if e.cache != nil {
+		e.initStream(r)
+	}
+	r.Run()
+	e.attach(ctx, r)
+}
+
+// replaceRoute subscribes the new route in place of the old one,
+// which is drained afterwards.
+func (e *exporter) replaceRoute(ctx context.Context, old, r *Route) {
+	e.logger.Info(fmt.Sprintf("Replacing route %s", r.Name))
+	e.Lock()
+	e.consumers[r.Name] = r
+	e.streams[r.Stream] = r.Broker
+	e.Unlock()
+	if e.cache != nil {
+		e.initStream(r)
+	}
+	r.Run()
+	e.swap(ctx, old, r)
+	e.retire(old)
+}
+
+func (e *exporter) removeRoute(ctx context.Context, r *Route) {
+	e.logger.Info(fmt.Sprintf("Removing route %s", r.Name))
+	e.detach(ctx, r)
+	e.Lock()
+	delete(e.consumers, r.Name)
+	e.Unlock()
+	e.retire(r)
+}
+
+// retire closes the route and lets its workers publish messages
+// already received in the background. Metrics of the route are
+// deleted once it is drained, unless it was replaced.
+func (e *exporter) retire(r *Route) {
+	r.Close()
+	e.draining.Add(1)
+	go func() {
+		defer e.draining.Done()
+		r.Wait()
+		e.logger.Info(fmt.Sprintf("Route %s drained", r.Name))
+		e.RLock()
+		_, ok := e.consumers[r.Name]
+		e.RUnlock()
+		if !ok {
+			deleteRouteMetrics(routeLabel(r.Stream))
+		}
+	}()
+}
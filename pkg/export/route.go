@@ -6,14 +6,17 @@ package export
 import (
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mainflux/export/pkg/config"
 	"github.com/mainflux/export/pkg/messages"
 	"github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
 	"github.com/mainflux/mainflux/pkg/messaging"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -26,25 +29,58 @@ const (
 	sliceLen     = 50
 	defaultType  = "default"
 	mainfluxType = "mfx"
+	natsType     = "nats"
 	JSON         = "application/senml+json"
+	streamPrefix = "export"
+	// Protocol of the messages published by import routes.
+	protocol = "mqtt"
 )
 
-var errUnsupportedType = errors.New("route type is not supported")
+var (
+	errUnsupportedType = errors.New("route type is not supported")
+	errRouteClosed     = errors.New("route is closed")
+	errBadTopic        = errors.New("topic can't be converted to NATS subject")
+)
 
 // Route - message route, tells which nats topic messages goes to which mqtt topic.
-// Later we can add direction and other combination like ( nats-nats).
+// Import routes go the other way and nats routes publish to the other NATS server.
 // Route is used in mfx and plain. route.go has base implementation and mfx.go
 // has extended implementation.
 
 type Route struct {
+	Name      string
 	NatsTopic string
 	MqttTopic string
 	Subtopic  string
+	Stream    string
+	Direction string
 	Messages  chan *messaging.Message
 	Workers   int
 	Type      string
-	logger    logger.Logger
-	pub       messages.Publisher
+	Broker    string
+	QoS       *byte
+	Retain    *bool
+	// NatsSubject is the subject nats routes publish to instead of MQTT topic.
+	NatsSubject string
+	// ContentType and TTL are set on messages published over MQTT 5.
+	ContentType string
+	TTL         time.Duration
+	Retention   messages.Retention
+	conf        config.Route
+	logger      logger.Logger
+	pub         messages.Publisher
+	closed      bool
+	stops       []chan struct{}
+	wg          sync.WaitGroup
+	mu          sync.RWMutex
+	// deadLetter receives the messages that fail to be processed.
+	deadLetter func(*messaging.Message, error)
+	// ignore tells which messages of the message bus are dropped.
+	ignore func(*messaging.Message) bool
+	// forward publishes the messages of import route to the message bus.
+	forward func(*messaging.Message) error
+	// hop adds the exporter to the hop trail of the exported message.
+	hop func(*messaging.Message, []byte, map[string]string) ([]byte, map[string]string, bool)
 }
 
 func NewRoute(rc config.Route, log logger.Logger, pub messages.Publisher) *Route {
@@ -52,52 +88,336 @@ func NewRoute(rc config.Route, log logger.Logger, pub messages.Publisher) *Route
 	if w == 0 {
 		w = workers
 	}
+	rc.Name = routeName(rc)
 	r := &Route{
+		Name:      rc.Name,
 		NatsTopic: rc.NatsTopic + "." + NatsAll,
 		MqttTopic: rc.MqttTopic,
 		Subtopic:  rc.SubTopic,
+		Stream:    streamPrefix + "." + rc.Name,
 		Type:      rc.Type,
+		Broker:    brokerName(rc),
+		Direction: rc.Direction,
 		Workers:   w,
 		Messages:  make(chan *messaging.Message, w),
+		Retain:    rc.Retain,
+		conf:      rc,
 		logger:    log,
 		pub:       pub,
 	}
+	if r.Direction == "" {
+		r.Direction = config.DirectionExport
+	}
+	if r.Direction == config.DirectionImport {
+		r.NatsTopic = rc.NatsTopic
+	}
+	if rc.QoS != nil {
+		qos := byte(*rc.QoS)
+		r.QoS = &qos
+	}
+	r.ContentType = rc.ContentType
+	r.NatsSubject = rc.NatsSubject
+	// TTL is validated when the route is created.
+	r.TTL, _ = time.ParseDuration(rc.TTL)
 	return r
 }
 
+// routeName returns the name of the route. Unnamed
+// routes are identified by their NATS topic.
+func routeName(rc config.Route) string {
+	if rc.Name != "" {
+		return rc.Name
+	}
+	return rc.NatsTopic
+}
+
+// retention parses the retention of messages buffered for the route.
+func retention(rc config.Route) (messages.Retention, error) {
+	r := messages.Retention{
+		MaxSize:  rc.MaxBufferSize,
+		Overflow: messages.Overflow(rc.Overflow),
+	}
+	if rc.MaxBufferAge != "" {
+		age, err := time.ParseDuration(rc.MaxBufferAge)
+		if err != nil {
+			return r, err
+		}
+		r.MaxAge = age
+	}
+	return r, r.Validate()
+}
+
 func (r *Route) Process(data []byte) ([]byte, error) {
+	payload, _, err := r.process(&messaging.Message{Payload: data})
+	return payload, err
+}
+
+// process returns the payload and the metadata of Mainflux message,
+// which is published as MQTT 5 user properties.
+func (r *Route) process(m *messaging.Message) ([]byte, map[string]string, error) {
 	switch r.Type {
 	case defaultType:
-		return data, nil
+		return m.Payload, nil, nil
 	case mainfluxType:
 		var msg messaging.Message
-		err := proto.Unmarshal(data, &msg)
+		err := proto.Unmarshal(m.Payload, &msg)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return msg.Payload, nil
+		return msg.Payload, properties(&msg), nil
+	case natsType:
+		data, err := proto.Marshal(m)
+		return data, nil, err
 	default:
-		return nil, errUnsupportedType
+		return nil, nil, errUnsupportedType
+	}
+}
+
+// properties returns the metadata of the message, skipping empty values.
+// Created is in nanoseconds since epoch.
+func properties(msg *messaging.Message) map[string]string {
+	props := map[string]string{}
+	add := func(k, v string) {
+		if v != "" {
+			props[k] = v
+		}
+	}
+	add("publisher", msg.Publisher)
+	add("protocol", msg.Protocol)
+	add("subtopic", msg.Subtopic)
+	if msg.Created > 0 {
+		add("created", strconv.FormatInt(msg.Created, 10))
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return props
+}
+
+// Handle passes the message to the route workers.
+func (r *Route) Handle(msg *messaging.Message) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return errRouteClosed
+	}
+	if r.ignore != nil && r.ignore(msg) {
+		return nil
+	}
+	route := routeLabel(r.Stream)
+	receivedMessages.WithLabelValues(route).Inc()
+	r.Messages <- msg
+	queueDepth.WithLabelValues(route).Set(float64(len(r.Messages)))
+	return nil
+}
+
+// Cancel is called when route is unsubscribed.
+func (r *Route) Cancel() error {
+	return nil
+}
+
+// Run starts route workers.
+func (r *Route) Run() {
+	r.Resize(r.Workers)
+}
+
+// Resize starts or stops workers so that route has n of them.
+// Size of the message buffer is not changed.
+func (r *Route) Resize(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for len(r.stops) < n {
+		stop := make(chan struct{})
+		r.stops = append(r.stops, stop)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.Consume(stop)
+		}()
+	}
+	for len(r.stops) > n {
+		last := len(r.stops) - 1
+		close(r.stops[last])
+		r.stops = r.stops[:last]
+	}
+	r.Workers = n
+}
+
+// Close stops accepting new messages. Workers exit
+// once messages already accepted are consumed.
+func (r *Route) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
 	}
+	r.closed = true
+	close(r.Messages)
+}
+
+func (r *Route) status() RouteStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return RouteStatus{
+		Name:        r.Name,
+		NatsTopic:   r.NatsTopic,
+		MqttTopic:   r.MqttTopic,
+		Broker:      r.Broker,
+		Type:        r.Type,
+		Direction:   r.Direction,
+		Workers:     r.Workers,
+		Queue:       len(r.Messages),
+		NatsSubject: r.NatsSubject,
+	}
+}
+
+// Wait blocks until all route workers exit.
+func (r *Route) Wait() {
+	r.wg.Wait()
+}
 
+// Consume publishes messages until the route is closed or stop is closed.
+func (r *Route) Consume(stop <-chan struct{}) {
+	for {
+		select {
+		case msg, ok := <-r.Messages:
+			if !ok {
+				return
+			}
+			queueDepth.WithLabelValues(routeLabel(r.Stream)).Set(float64(len(r.Messages)))
+			r.consume(msg)
+		case <-stop:
+			return
+		}
+	}
 }
 
-func (r *Route) Consume() {
-	for msg := range r.Messages {
-		payload, err := r.Process(msg.Payload)
+func (r *Route) consume(msg *messaging.Message) {
+	if r.forward != nil {
+		if err := r.forward(msg); err != nil {
+			r.logger.Error(fmt.Sprintf("Failed to import message on route %s: %s", r.Name, err))
+			return
+		}
+		r.msgDebug(msg.Channel, msg.Payload)
+		return
+	}
+	payload, props, err := r.process(msg)
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to process message on route %s: %s", r.Name, err))
+		if r.deadLetter != nil {
+			r.deadLetter(msg, err)
+		}
+		return
+	}
+	if err := r.publish(msg, payload, props); err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to publish on route %s: %s", r.MqttTopic, err))
+	}
+	r.msgDebug(msg.Channel, payload)
+}
+
+// topic returns the MQTT topic the message is published to. Nats routes
+// publish to the subject with channel and subtopic of the message appended.
+func (r *Route) topic(msg *messaging.Message) string {
+	if r.Type == natsType {
+		subject := fmt.Sprintf("%s.%s", r.NatsSubject, msg.Channel)
+		if msg.Subtopic != "" {
+			subject = fmt.Sprintf("%s.%s", subject, msg.Subtopic)
+		}
+		return subject
+	}
+	topic := r.MqttTopic
+	if r.Subtopic != "" {
+		topic = fmt.Sprintf("%s/%s", r.MqttTopic, r.Subtopic)
+	}
+	return fmt.Sprintf("%s/%s", topic, strings.ReplaceAll(msg.Channel, ".", "/"))
+}
+
+// publish publishes the processed message to the route topic, unless
+// the message already passed through the exporter.
+func (r *Route) publish(msg *messaging.Message, payload []byte, props map[string]string) error {
+	if r.hop != nil {
+		var ok bool
+		if payload, props, ok = r.hop(msg, payload, props); !ok {
+			return nil
+		}
+	}
+	topic := r.topic(msg)
+	key := msg.Channel
+	if msg.Subtopic != "" {
+		key = fmt.Sprintf("%s.%s", msg.Channel, msg.Subtopic)
+	}
+	opts := []messages.Option{messages.WithKey(key)}
+	if r.QoS != nil {
+		opts = append(opts, messages.WithQoS(*r.QoS))
+	}
+	if r.Retain != nil {
+		opts = append(opts, messages.WithRetain(*r.Retain))
+	}
+	if msg.Created > 0 {
+		opts = append(opts, messages.WithCreated(time.Unix(0, msg.Created)))
+	}
+	if r.ContentType != "" {
+		opts = append(opts, messages.WithContentType(r.ContentType))
+	}
+	if r.TTL > 0 {
+		opts = append(opts, messages.WithExpiry(r.TTL))
+	}
+	if props != nil {
+		opts = append(opts, messages.WithProperties(props))
+	}
+	// Only HTTP endpoints reject messages, which are dead-lettered as received,
+	// so the retry processes them again. Targets of other routes are NATS servers.
+	if r.conf.Target != "" && r.Type != natsType {
+		src, err := proto.Marshal(msg)
 		if err != nil {
-			r.logger.Error(fmt.Sprintf("Failed to consume message %s", err))
+			return err
 		}
-		topic := r.MqttTopic
-		if r.Subtopic != "" {
-			topic = fmt.Sprintf("%s/%s", r.MqttTopic, r.Subtopic)
+		opts = append(opts, messages.WithSource(src))
+	}
+	return r.pub.Publish(r.Stream, topic, payload, opts...)
+}
+
+// inbound converts the MQTT message received by import route to Mainflux
+// message. Channel and subtopic are taken from channels/<channel_id>/messages
+// topics, other topics are published to the route channel with the whole
+// topic as subtopic. Publisher and created time are taken from MQTT 5
+// properties, if they are set.
+func (r *Route) inbound(topic string, payload []byte, props map[string]string, publisher string) (*messaging.Message, error) {
+	channel, levels := r.NatsTopic, strings.Split(topic, "/")
+	if len(levels) >= 3 && levels[0] == Channels && levels[1] != "" && levels[2] == Messages {
+		channel, levels = levels[1], levels[3:]
+	}
+	if channel == "" {
+		return nil, errors.Wrap(errBadTopic, errors.New(topic))
+	}
+	var tokens []string
+	for _, l := range levels {
+		if l == "" {
+			continue
 		}
-		topic = fmt.Sprintf("%s/%s", topic, strings.ReplaceAll(msg.Channel, ".", "/"))
-		if err := r.pub.Publish(msg.Channel, topic, payload); err != nil {
-			r.logger.Error(fmt.Sprintf("Failed to publish on route %s: %s", r.MqttTopic, err))
+		if strings.ContainsAny(l, ".*> \t\r\n") {
+			return nil, errors.Wrap(errBadTopic, errors.New(topic))
 		}
-		r.msgDebug(msg.Channel, payload)
+		tokens = append(tokens, l)
+	}
+	msg := &messaging.Message{
+		Channel:   channel,
+		Subtopic:  strings.Join(tokens, "."),
+		Publisher: publisher,
+		Protocol:  protocol,
+		Payload:   payload,
+		Created:   time.Now().UnixNano(),
+	}
+	if p, ok := props["publisher"]; ok {
+		msg.Publisher = p
+	}
+	if c, err := strconv.ParseInt(props["created"], 10, 64); err == nil {
+		msg.Created = c
 	}
+	return msg, nil
 }
 
 func (r *Route) msgDebug(sub string, payload []byte) {
@@ -0,0 +1,97 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"fmt"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+func (e *exporter) ListRoutes() []config.Route {
+	e.RLock()
+	defer e.RUnlock()
+	return append([]config.Route{}, e.cfg.Routes...)
+}
+
+func (e *exporter) ViewRoute(name string) (config.Route, error) {
+	routes := e.ListRoutes()
+	if i := find(routes, name); i >= 0 {
+		return routes[i], nil
+	}
+	return config.Route{}, ErrNotFound
+}
+
+func (e *exporter) CreateRoute(rc config.Route) error {
+	return e.updateRoutes(func(routes []config.Route) ([]config.Route, error) {
+		if find(routes, routeName(rc)) >= 0 {
+			return nil, ErrConflict
+		}
+		return append(routes, rc), nil
+	})
+}
+
+func (e *exporter) UpdateRoute(name string, rc config.Route) error {
+	return e.updateRoutes(func(routes []config.Route) ([]config.Route, error) {
+		i := find(routes, name)
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		if n := routeName(rc); n != name && find(routes, n) >= 0 {
+			return nil, ErrConflict
+		}
+		routes[i] = rc
+		return routes, nil
+	})
+}
+
+func (e *exporter) RemoveRoute(name string) error {
+	return e.updateRoutes(func(routes []config.Route) ([]config.Route, error) {
+		i := find(routes, name)
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		return append(routes[:i], routes[i+1:]...), nil
+	})
+}
+
+// updateRoutes applies the change of the routes to the running
+// service and saves the configuration. If configuration can't be
+// saved, the change is rolled back, so it is not lost on restart.
+func (e *exporter) updateRoutes(update func([]config.Route) ([]config.Route, error)) error {
+	e.routesMu.Lock()
+	defer e.routesMu.Unlock()
+
+	e.RLock()
+	old := e.cfg
+	routes := append([]config.Route{}, e.cfg.Routes...)
+	e.RUnlock()
+
+	routes, err := update(routes)
+	if err != nil {
+		return err
+	}
+	c := old
+	c.Routes = routes
+	if err := e.Reload(c); err != nil {
+		return err
+	}
+	if err := config.Save(c); err != nil {
+		if rerr := e.Reload(old); rerr != nil {
+			e.logger.Error(fmt.Sprintf("Failed to roll back routes change: %s", rerr))
+		}
+		return errors.Wrap(errSaveConfig, err)
+	}
+	return nil
+}
+
+func find(routes []config.Route, name string) int {
+	for i, r := range routes {
+		if routeName(r) == name {
+			return i
+		}
+	}
+	return -1
+}
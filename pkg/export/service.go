@@ -5,26 +5,63 @@ package export
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/mainflux/export/pkg/config"
 	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux"
 	logger "github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
 	"github.com/mainflux/mainflux/pkg/messaging"
 )
 
-var errNoCacheConfigured = errors.New("No cache configured")
+var (
+	errNoCacheConfigured = errors.New("No cache configured")
+	errNotConnected      = errors.New("MQTT client is not connected")
+	errPublishTimeout    = errors.New("MQTT publish timed out")
+)
 
 type Exporter interface {
 	Start(queue string) errors.Error
 	Subscribe(ctx context.Context)
+	Status() Status
 	Logger() logger.Logger
+	// ListRoutes returns configured routes.
+	ListRoutes() []config.Route
+	// ViewRoute returns the route with the given name.
+	ViewRoute(name string) (config.Route, error)
+	// CreateRoute adds the route and saves the configuration.
+	CreateRoute(r config.Route) error
+	// UpdateRoute replaces the route with the given name
+	// and saves the configuration.
+	UpdateRoute(name string, r config.Route) error
+	// RemoveRoute removes the route with the given name
+	// and saves the configuration.
+	RemoveRoute(name string) error
+	// ListDeadLetters returns up to limit oldest messages
+	// that routes failed to process.
+	ListDeadLetters(limit int64) ([]DeadLetter, error)
+	// RetryDeadLetters processes the dead letters with given IDs again,
+	// or all of them if no IDs are given. Dead letters are removed once
+	// they are processed, the ones that fail again are kept.
+	RetryDeadLetters(ids ...string) (RetryResult, error)
+	// PurgeDeadLetters removes the dead letters with given IDs, or all
+	// of them if no IDs are given, and returns the number removed.
+	PurgeDeadLetters(ids ...string) (int, error)
+	// Reload applies the new configuration without restarting the service.
+	// Invalid configuration is rejected and the running one is kept.
+	Reload(c config.Config) error
+	// Shutdown stops consuming messages, waits for the route workers to
+	// publish or store messages already received and closes the connection
+	// to MQTT broker. When ctx is done, remaining messages are stored
+	// into the cache without being published.
+	Shutdown(ctx context.Context) error
 }
 type Service interface {
 	Exporter
@@ -34,12 +71,33 @@ type Service interface {
 var _ Service = (*exporter)(nil)
 
 type exporter struct {
-	id        string
-	mqtt      mqtt.Client
-	cfg       config.Config
+	brokers map[string]*broker
+	bus     connection
+	cfg     config.Config
+	// Routes by name and NATS subscriptions by subject.
 	consumers map[string]*Route
-	logger    logger.Logger
-	pubsub    messaging.PubSub
+	subs      map[string]*subscription
+	// Broker names by route stream.
+	streams  map[string]string
+	cache    *messages.RetentionCache
+	buffered map[string]bool
+	replay   chan struct{}
+	done     chan struct{}
+	// When set, messages are stored without trying to publish them.
+	storeOnly atomic.Bool
+	// Tracks routes removed by reload until they are drained.
+	draining sync.WaitGroup
+	reloadMu sync.Mutex
+	routesMu sync.Mutex
+	logger   logger.Logger
+	pubsub   messaging.PubSub
+	// Serializes retrying and purging of dead letters.
+	deadLettersMu sync.Mutex
+	// Hop trails of the imported messages. Instance ID and max hops
+	// are set on start, like the rest of the exp section.
+	trails     trails
+	instanceID string
+	maxHops    int
 	sync.RWMutex
 }
 
@@ -49,163 +107,694 @@ const (
 	Channels = "channels"
 	Messages = "messages"
 	svcName  = "export"
+
+	// Number of messages read from the stream at once during republishing.
+	replayBatch    = 100
+	publishTimeout = 10 * time.Second
+	// Streams left buffered by failed republishing are retried this often.
+	replayInterval = 10 * time.Second
+
+	// Backoff between initial connection attempts.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// Time in milliseconds to wait for the work to complete on disconnect.
+	disconnectQuiesce = 250
+
+	heartbeatSubject  = "heartbeat"
+	heartbeatInterval = 10 * time.Second
 )
 
-var errNoRoutesConfigured = errors.New("No routes configured")
+var (
+	// ErrInvalidConfig indicates invalid configuration.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrNotFound indicates non-existent route.
+	ErrNotFound = errors.New("route not found")
+	// ErrConflict indicates that route already exists.
+	ErrConflict = errors.New("route already exists")
+
+	errNoRoutesConfigured = errors.New("No routes configured")
+	errBadSubject         = errors.New("Bad NATS subject")
+	errBadName            = errors.New("Bad route name")
+	errDuplicateRoute     = errors.New("Duplicate route name")
+	errBadRetention       = errors.New("Bad route retention")
+	errBadQoS             = errors.New("Bad route QoS")
+	errBadWorkers         = errors.New("Bad route workers")
+	errBadTTL             = errors.New("Bad route TTL")
+	errBadDirection       = errors.New("Bad route direction")
+	errBadFilter          = errors.New("Bad MQTT topic filter")
+	errSaveConfig         = errors.New("failed to save configuration")
+)
 
 // New create new instance of export service.
-func New(c config.Config, l logger.Logger, pubsub messaging.PubSub) (Service, error) {
+// If cache is nil messages that fail to be published are dropped.
+// Connection to MQTT broker is established in the background,
+// so service can be started while the broker is unreachable.
+func New(c config.Config, cache messages.Cache, l logger.Logger, pubsub messaging.PubSub) (Service, error) {
 	routes := make(map[string]*Route)
-	id := fmt.Sprintf("export-%s", c.MQTT.Username)
 
+	cfgs, err := brokerConfigs(c)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidConfig, err)
+	}
+	id, err := instanceID(c.Server)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidConfig, err)
+	}
+	if _, err := deadLetterRetention(c.DeadLetter); err != nil {
+		return nil, errors.Wrap(ErrInvalidConfig, err)
+	}
 	e := exporter{
-		id:        id,
+		brokers:   make(map[string]*broker),
+		bus:       connection{name: "pubsub"},
 		logger:    l,
 		cfg:       c,
 		consumers: routes,
+		subs:      make(map[string]*subscription),
+		streams:   make(map[string]string),
+		buffered:  make(map[string]bool),
+		replay:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
 		pubsub:    pubsub,
 	}
-	client, err := e.mqttConnect(c, l)
-	if err != nil {
-		return &e, err
+	e.instanceID, e.maxHops = id, c.Server.MaxHops
+	if cache != nil {
+		e.cache = messages.NewRetentionCache(cache, e.dropped)
 	}
-	e.mqtt = client
+	// Connection to the message bus is established before the service is created.
+	e.bus.set(StateConnected)
+	e.updateBrokers(cfgs)
 	return &e, nil
 }
 
-// Start method loads route configuration.
+// Start method loads route configuration. Invalid routes are logged
+// and dropped from the configuration, the same way as Reload would
+// reject them, so they don't fail the route changes made later.
 func (e *exporter) Start(queue string) errors.Error {
-	var route *Route
-	for _, r := range e.cfg.Routes {
-		route = e.newRoute(r)
-		if !e.validateSubject(route.NatsTopic) {
-			e.logger.Error("Bad NATS subject:" + route.NatsTopic)
+	cfgs := make(map[string]config.MQTT, len(e.brokers))
+	for name, b := range e.brokers {
+		cfgs[name] = b.cfg
+	}
+	valid := make([]config.Route, 0, len(e.cfg.Routes))
+	for _, rc := range e.cfg.Routes {
+		route, err := e.checkRoute(rc, cfgs)
+		if err != nil {
+			e.logger.Error(fmt.Sprintf("Dropping route %s: %s", routeName(rc), err))
 			continue
 		}
-		e.consumers[route.NatsTopic] = route
-
+		if _, ok := e.consumers[route.Name]; ok {
+			e.logger.Error(fmt.Sprintf("%s: %s", errDuplicateRoute, route.Name))
+			return errDuplicateRoute
+		}
+		e.consumers[route.Name] = route
+		e.streams[route.Stream] = route.Broker
+		valid = append(valid, rc)
 	}
 	if len(e.consumers) == 0 {
 		return errNoRoutesConfigured
 	}
+	if err := checkTrails(e.consumers, cfgs); err != nil {
+		e.logger.Error(err.Error())
+		return errNoHopTrail
+	}
+	e.Lock()
+	e.cfg.Routes = valid
+	e.Unlock()
+
+	if e.cache != nil {
+		e.initDeadLetters()
+		for _, r := range e.consumers {
+			e.initStream(r)
+		}
+		go e.republish()
+		e.triggerReplay()
+	}
+	go e.heartbeat()
 
 	return nil
 }
 
-func (e *exporter) Publish(stream, topic string, payload []byte) error {
-	if err := e.publish(topic, payload); err != nil {
-		return errors.Wrap(errNoCacheConfigured, err)
+// heartbeat periodically publishes to the message bus,
+// tracking the state of the message bus connection.
+func (e *exporter) heartbeat() {
+	subject := fmt.Sprintf("%s.%s.service", heartbeatSubject, svcName)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.pubsub.Publish(context.Background(), subject, &messaging.Message{Channel: subject}); err != nil {
+				e.logger.Error(fmt.Sprintf("Failed to publish heartbeat, %s", err))
+				e.bus.failed(StateDisconnected, err)
+				continue
+			}
+			e.bus.set(StateConnected)
+		case <-e.done:
+			return
+		}
 	}
-	return nil
 }
 
-func (e *exporter) Logger() logger.Logger {
-	return e.logger
+// initStream applies retention to the route stream. Messages left in
+// the stream from the previous run are republished before the new ones.
+func (e *exporter) initStream(r *Route) {
+	if err := e.cache.SetRetention(r.Stream, r.Retention); err != nil {
+		e.logger.Error(fmt.Sprintf("Failed to apply retention to stream %s: %s", r.Stream, err))
+	}
+	n, err := e.cache.Len(r.Stream)
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("Failed to read stream %s: %s", r.Stream, err))
+		return
+	}
+	if n > 0 {
+		e.Lock()
+		e.buffered[r.Stream] = true
+		e.Unlock()
+	}
 }
 
-func (e *exporter) newRoute(r config.Route) *Route {
-	return NewRoute(r, e.logger, e)
+// initDeadLetters applies retention to the stored dead letters.
+func (e *exporter) initDeadLetters() {
+	e.RLock()
+	dc := e.cfg.DeadLetter
+	e.RUnlock()
+	// Retention is validated when the configuration is loaded.
+	r, _ := deadLetterRetention(dc)
+	if err := e.cache.SetRetention(deadLetterStream, r); err != nil {
+		e.logger.Error(fmt.Sprintf("Failed to apply retention to stream %s: %s", deadLetterStream, err))
+	}
 }
 
-type handleFunc func(msg *messaging.Message) error
-
-func (h handleFunc) Handle(msg *messaging.Message) error {
-	return h(msg)
+// Publish publishes message to the MQTT topic. If publishing fails,
+// message is stored in the stream and republished once connection
+// is reestablished. While stream is not drained, new messages are
+// appended to it, so the order of messages is preserved. Messages
+// queued by the broker client are handled once they are sent.
+func (e *exporter) Publish(stream, topic string, payload []byte, opts ...messages.Option) error {
+	o := messages.NewOptions(opts...)
+	if e.storeOnly.Load() {
+		if e.cache == nil {
+			return errNoCacheConfigured
+		}
+		return e.store(stream, topic, payload, o)
+	}
+	if e.cache != nil {
+		e.RLock()
+		buffered := e.buffered[stream]
+		e.RUnlock()
+		if buffered {
+			return e.store(stream, topic, payload, o)
+		}
+	}
+	queued := e.queueRoute(stream, topic, payload, o, func(err error) {
+		if err := e.unsent(stream, topic, payload, o, err); err != nil {
+			e.logger.Error(fmt.Sprintf("Failed to publish to %s on route %s: %s", topic, routeLabel(stream), err))
+		}
+	})
+	if queued {
+		return nil
+	}
+	return e.unsent(stream, topic, payload, o, e.publishRoute(stream, topic, payload, o))
+}
 
+// unsent handles the result of publishing the message. Message the target
+// rejected is dead-lettered and the one that failed is stored in the stream.
+func (e *exporter) unsent(stream, topic string, payload []byte, o messages.Options, err error) error {
+	if err == nil || e.reject(stream, payload, o, err) {
+		return nil
+	}
+	if e.cache == nil {
+		return errors.Wrap(errNoCacheConfigured, err)
+	}
+	e.logger.Warn(fmt.Sprintf("Failed to publish to %s, storing message in stream %s: %s", topic, stream, err))
+	return e.store(stream, topic, payload, o)
 }
 
-func (h handleFunc) Cancel() error {
-	return nil
+// publishRoute publishes the message of the route stream and records
+// the route metrics. Zero created time means that it is unknown.
+func (e *exporter) publishRoute(stream, topic string, payload []byte, o messages.Options) error {
+	b, err := e.broker(stream)
+	if err != nil {
+		failedMessages.WithLabelValues(routeLabel(stream)).Inc()
+		return err
+	}
+	start := time.Now()
+	return e.sent(stream, start, payload, o, b.publish(topic, payload, o))
 }
 
-func handle(mesChan chan *messaging.Message) handleFunc {
-	return func(msg *messaging.Message) error {
-		mesChan <- msg
-		return nil
+// queueRoute queues the message of the route stream if its broker client
+// sends the messages in the background, and reports if it did. Done is
+// called with the result of sending the message, once route metrics are
+// recorded, and is called before returning if queuing fails.
+func (e *exporter) queueRoute(stream, topic string, payload []byte, o messages.Options, done func(error)) bool {
+	b, err := e.broker(stream)
+	if err != nil {
+		return false
+	}
+	q, ok := b.client.(queueClient)
+	if !ok {
+		return false
+	}
+	start := time.Now()
+	err = q.Enqueue(topic, payload, o, func(err error) {
+		done(e.sent(stream, start, payload, o, err))
+	})
+	if err != nil {
+		done(e.sent(stream, start, payload, o, err))
 	}
+	return true
 }
 
-func (e *exporter) Subscribe(ctx context.Context) {
-	for _, r := range e.consumers {
-		if err := e.pubsub.Subscribe(ctx, svcName, r.NatsTopic, handle(r.Messages)); err != nil {
-			e.logger.Error(fmt.Sprintf("Failed to subscribe to NATS %s: %s", r.NatsTopic, err))
-		}
-		for i := 0; i < r.Workers; i++ {
-			go r.Consume()
+// flushRoute sends the messages queued by the broker client of the route
+// stream without waiting for the batches to fill.
+func (e *exporter) flushRoute(stream string) {
+	if b, err := e.broker(stream); err == nil {
+		if q, ok := b.client.(queueClient); ok {
+			q.Flush()
 		}
 	}
 }
 
-func (e *exporter) publish(topic string, payload []byte) error {
-	token := e.mqtt.Publish(topic, byte(e.cfg.MQTT.QoS), e.cfg.MQTT.Retain, payload)
-	if token.Wait() && token.Error() != nil {
-		e.logger.Error(fmt.Sprintf("Failed to publish to topic %s", topic))
-		return token.Error()
+// sent records the route metrics of the message published since start.
+func (e *exporter) sent(stream string, start time.Time, payload []byte, o messages.Options, err error) error {
+	route := routeLabel(stream)
+	if err != nil {
+		failedMessages.WithLabelValues(route).Inc()
+		return err
+	}
+	now := time.Now()
+	publishLatency.WithLabelValues(route).Observe(now.Sub(start).Seconds())
+	payloadSize.WithLabelValues(route).Observe(float64(len(payload)))
+	publishedMessages.WithLabelValues(route).Inc()
+	if !o.Created.IsZero() {
+		lag.WithLabelValues(route).Observe(now.Sub(o.Created).Seconds())
 	}
 	return nil
 }
 
-func (e *exporter) validateSubject(sub string) bool {
-	if sub == "" {
-		return false
+func (e *exporter) store(stream, topic string, payload []byte, o messages.Options) error {
+	m := messages.Msg{
+		Topic:       topic,
+		Payload:     string(payload),
+		Created:     time.Now().UnixNano(),
+		QoS:         o.QoS,
+		Retain:      o.Retain,
+		ContentType: o.ContentType,
+		Expiry:      int64(o.Expiry),
+		Properties:  o.Properties,
+		Key:         o.Key,
+		Source:      string(o.Source),
 	}
-	if strings.ContainsAny(sub, " \t\r\n") {
-		return false
+	if !o.Created.IsZero() {
+		m.Origin = o.Created.UnixNano()
 	}
-	tokens := strings.Split(sub, ".")
-	for _, t := range tokens {
-		if len(t) == 0 {
-			return false
+	// Cache is called without holding the lock, so routes buffer their
+	// messages concurrently. Stream is marked as buffered once the message
+	// is added, so drain that finds it empty can't unmark it afterwards.
+	if _, err := e.cache.Add(stream, m.Encode()); err != nil {
+		if err == messages.ErrDropped {
+			// Dropped message is counted by the retention.
+			return nil
+		}
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.buffered[stream] = true
+	bufferedMessages.WithLabelValues(routeLabel(stream)).Inc()
+	// Publish can fail or time out while the connection stays up,
+	// in which case no reconnect triggers the replay.
+	if b, ok := e.brokers[e.streams[stream]]; ok && b.client.IsConnectionOpen() {
+		e.triggerReplay()
+	}
+	return nil
+}
+
+func (e *exporter) dropped(stream, reason string, count int) {
+	droppedMessages.WithLabelValues(routeLabel(stream), reason).Add(float64(count))
+	e.logger.Debug(fmt.Sprintf("Dropped %d messages from stream %s: %s", count, stream, reason))
+}
+
+func (e *exporter) triggerReplay() {
+	select {
+	case e.replay <- struct{}{}:
+	default:
+	}
+}
+
+// republish drains the streams every time the connection is established,
+// once messages are stored while it is up and periodically, so streams
+// that failed to drain are retried.
+func (e *exporter) republish() {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.replay:
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+		e.RLock()
+		streams := make([]string, 0, len(e.buffered))
+		for s, ok := range e.buffered {
+			// Streams are drained once their broker connects.
+			if b, found := e.brokers[e.streams[s]]; ok && found && b.client.IsConnectionOpen() {
+				streams = append(streams, s)
+			}
+		}
+		e.RUnlock()
+		for _, s := range streams {
+			if err := e.drain(s); err != nil {
+				e.logger.Warn(fmt.Sprintf("Failed to republish messages from stream %s: %s", s, err))
+			}
 		}
 	}
-	return true
 }
 
-func (e *exporter) conn(client mqtt.Client) {
-	e.logger.Debug(fmt.Sprintf("Client %s connected", e.id))
+func (e *exporter) drain(stream string) error {
+	for {
+		entries, err := e.cache.Read(stream, replayBatch)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			e.Lock()
+			defer e.Unlock()
+			// Message could be stored while the lock was not held.
+			n, err := e.cache.Len(stream)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				e.buffered[stream] = false
+				e.logger.Info(fmt.Sprintf("Stream %s drained", stream))
+				if _, ok := e.consumers[routeLabel(stream)]; !ok {
+					// Route was removed before its stream was drained.
+					deleteRouteMetrics(routeLabel(stream))
+				}
+				return nil
+			}
+			// Drain will be triggered again on the next replay.
+			e.triggerReplay()
+			return nil
+		}
+		// Messages are removed once per batch, rather than one by one,
+		// since every removal is synced to disk by the file cache.
+		done, err := e.replayEntries(stream, entries)
+		if rerr := e.cache.Remove(stream, done...); rerr != nil {
+			return rerr
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
-func (e *exporter) lost(client mqtt.Client, err error) {
-	e.logger.Debug(fmt.Sprintf("Client %s disconnected", e.id))
+// replayEntries republishes the stream entries in order and returns the IDs
+// of the ones that can be removed, which are published, rejected, expired or
+// malformed. Entries queued by the broker client are flushed once they are
+// all queued, so they fill the batches, and removed once they are sent.
+func (e *exporter) replayEntries(stream string, entries []messages.Entry) ([]string, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		done    = make([]string, 0, len(entries))
+		failure error
+	)
+	// result records the result of republishing the entry.
+	result := func(id string, payload []byte, o messages.Options, err error) error {
+		switch {
+		case err == nil:
+			replayedMessages.WithLabelValues(routeLabel(stream)).Inc()
+		case !e.reject(stream, payload, o, err):
+			mu.Lock()
+			if failure == nil {
+				failure = err
+			}
+			mu.Unlock()
+			return err
+		}
+		mu.Lock()
+		done = append(done, id)
+		mu.Unlock()
+		return nil
+	}
+	for _, entry := range entries {
+		var m messages.Msg
+		if err := m.Decode(entry.Values); err != nil {
+			e.logger.Error(fmt.Sprintf("Dropping malformed message %s from stream %s: %s", entry.ID, stream, err))
+			mu.Lock()
+			done = append(done, entry.ID)
+			mu.Unlock()
+			continue
+		}
+		o := messages.Options{
+			QoS:         m.QoS,
+			Retain:      m.Retain,
+			ContentType: m.ContentType,
+			Properties:  m.Properties,
+			Key:         m.Key,
+		}
+		if m.Source != "" {
+			o.Source = []byte(m.Source)
+		}
+		if m.Origin > 0 {
+			o.Created = time.Unix(0, m.Origin)
+		}
+		if m.Expiry > 0 {
+			// Message expires the same time as if it was published when stored.
+			o.Expiry = time.Duration(m.Expiry) - time.Since(time.Unix(0, m.Created))
+			if o.Expiry <= 0 {
+				mu.Lock()
+				done = append(done, entry.ID)
+				mu.Unlock()
+				e.dropped(stream, messages.ReasonExpired, 1)
+				continue
+			}
+		}
+		id, payload := entry.ID, []byte(m.Payload)
+		wg.Add(1)
+		queued := e.queueRoute(stream, m.Topic, payload, o, func(err error) {
+			defer wg.Done()
+			_ = result(id, payload, o, err)
+		})
+		if queued {
+			continue
+		}
+		wg.Done()
+		if err := result(id, payload, o, e.publishRoute(stream, m.Topic, payload, o)); err != nil {
+			break
+		}
+	}
+	e.flushRoute(stream)
+	wg.Wait()
+	return done, failure
 }
 
-func (e *exporter) mqttConnect(conf config.Config, logger logger.Logger) (mqtt.Client, error) {
-	opts := mqtt.NewClientOptions().
-		AddBroker(conf.MQTT.Host).
-		SetClientID(e.id).
-		SetCleanSession(true).
-		SetAutoReconnect(true).
-		SetOnConnectHandler(e.conn).
-		SetConnectionLostHandler(e.lost)
+func (e *exporter) Shutdown(ctx context.Context) error {
+	close(e.done)
+	// Wait for reload in progress to complete.
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+	e.Lock()
+	routes := make([]*Route, 0, len(e.consumers))
+	for _, r := range e.consumers {
+		routes = append(routes, r)
+	}
+	subs := e.subs
+	e.subs = make(map[string]*subscription)
+	e.Unlock()
+	for subject := range subs {
+		if err := e.pubsub.Unsubscribe(ctx, svcName, subject); err != nil {
+			e.logger.Warn(fmt.Sprintf("Failed to unsubscribe from NATS %s: %s", subject, err))
+		}
+	}
+	for _, r := range routes {
+		r.Close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		for _, r := range routes {
+			r.Wait()
+		}
+		// Routes removed by reload could still be draining.
+		e.draining.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		e.logger.Warn("Shutdown deadline exceeded, storing remaining messages")
+		// Workers exit as soon as publishing in progress completes.
+		e.storeOnly.Store(true)
+		<-stopped
+	}
 
-	if conf.MQTT.Username != "" && conf.MQTT.Password != "" {
-		opts.SetUsername(conf.MQTT.Username)
-		opts.SetPassword(conf.MQTT.Password)
+	e.RLock()
+	brokers := make([]*broker, 0, len(e.brokers))
+	for _, b := range e.brokers {
+		brokers = append(brokers, b)
+	}
+	e.RUnlock()
+	for _, b := range brokers {
+		// Messages queued by the client are sent unless ctx is done,
+		// otherwise they are stored once the client disconnects.
+		if q, ok := b.client.(queueClient); ok {
+			q.Drain(ctx)
+		}
+		b.offline()
+		b.client.Disconnect()
+		b.conn.set(StateDisconnected)
 	}
+	return err
+}
 
-	if conf.MQTT.MTLS {
-		cfg := &tls.Config{
-			InsecureSkipVerify: conf.MQTT.SkipTLSVer,
+func (e *exporter) Status() Status {
+	e.RLock()
+	consumers := make([]*Route, 0, len(e.consumers))
+	for _, r := range e.consumers {
+		consumers = append(consumers, r)
+	}
+	e.RUnlock()
+	routes := make([]RouteStatus, len(consumers))
+	for i, r := range consumers {
+		routes[i] = r.status()
+		if e.cache == nil {
+			continue
 		}
+		n, err := e.cache.Len(r.Stream)
+		if err != nil {
+			e.logger.Warn(fmt.Sprintf("Failed to read length of stream %s: %s", r.Stream, err))
+			continue
+		}
+		routes[i].Buffered = n
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Name < routes[j].Name
+	})
+	return Status{
+		Version:   mainflux.Version,
+		Commit:    mainflux.Commit,
+		BuildTime: mainflux.BuildTime,
+		Brokers:   e.brokerStatus(),
+		PubSub:    e.bus.get(),
+		Routes:    routes,
+	}
+}
+
+func (e *exporter) Logger() logger.Logger {
+	return e.logger
+}
 
-		if conf.MQTT.CA != nil {
-			cfg.RootCAs = x509.NewCertPool()
-			cfg.RootCAs.AppendCertsFromPEM(conf.MQTT.CA)
+func (e *exporter) newRoute(rc config.Route) (*Route, error) {
+	// Workers size the channel of the route, so they are checked first.
+	if rc.Workers < 0 {
+		return nil, errors.Wrap(errBadWorkers, errors.New(strconv.Itoa(rc.Workers)))
+	}
+	if rc.Direction == config.DirectionImport && rc.Type == "" {
+		rc.Type = defaultType
+	}
+	r := NewRoute(rc, e.logger, e)
+	r.deadLetter = func(msg *messaging.Message, err error) {
+		e.deadLetter(r.Name, msg, err)
+	}
+	r.ignore = e.isDeadLetter
+	if strings.ContainsAny(r.Name, " \t\r\n/") {
+		return nil, errors.Wrap(errBadName, errors.New(r.Name))
+	}
+	switch r.Direction {
+	case config.DirectionExport:
+		if !e.validateSubject(r.NatsTopic) {
+			return nil, errors.Wrap(errBadSubject, errors.New(r.NatsTopic))
 		}
-		if conf.MQTT.TLSCert.Certificate != nil {
-			cfg.Certificates = []tls.Certificate{conf.MQTT.TLSCert}
+		r.hop = func(msg *messaging.Message, payload []byte, props map[string]string) ([]byte, map[string]string, bool) {
+			return e.addHop(r, msg, payload, props)
+		}
+	case config.DirectionImport:
+		if !validFilter(r.MqttTopic) {
+			return nil, errors.Wrap(errBadFilter, errors.New(r.MqttTopic))
+		}
+		// NATS topic is the channel, which can't contain wildcards.
+		if r.NatsTopic != "" && (!e.validateSubject(r.NatsTopic) || strings.ContainsAny(r.NatsTopic, "*>")) {
+			return nil, errors.Wrap(errBadSubject, errors.New(r.NatsTopic))
+		}
+		r.forward = func(msg *messaging.Message) error {
+			return e.forward(r, msg)
+		}
+	default:
+		return nil, errors.Wrap(errBadDirection, errors.New(r.Direction))
+	}
+	if r.Type != defaultType && r.Type != mainfluxType && (r.Type != natsType || r.Direction == config.DirectionImport) {
+		return nil, errors.Wrap(errUnsupportedType, errors.New(r.Type))
+	}
+	if err := e.validateTarget(rc); err != nil {
+		return nil, err
+	}
+	if rc.QoS != nil && (*rc.QoS < 0 || *rc.QoS > 2) {
+		return nil, errors.Wrap(errBadQoS, errors.New(strconv.Itoa(*rc.QoS)))
+	}
+	if rc.TTL != "" {
+		if ttl, err := time.ParseDuration(rc.TTL); err != nil || ttl < 0 {
+			return nil, errors.Wrap(errBadTTL, errors.New(rc.TTL))
 		}
+	}
+	ret, err := retention(rc)
+	if err != nil {
+		return nil, errors.Wrap(errBadRetention, err)
+	}
+	r.Retention = ret
+	return r, nil
+}
+
+// checkRoute creates the route and checks that its broker
+// is configured and supports it.
+func (e *exporter) checkRoute(rc config.Route, cfgs map[string]config.MQTT) (*Route, error) {
+	r, err := e.newRoute(rc)
+	if err != nil {
+		return nil, err
+	}
+	bc, ok := cfgs[r.Broker]
+	if !ok {
+		return nil, errors.Wrap(errUnknownBroker, errors.New(r.Broker))
+	}
+	if err := checkBroker(r, bc); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-		opts.SetTLSConfig(cfg)
-		opts.SetProtocolVersion(4)
+func (e *exporter) Subscribe(ctx context.Context) {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+	e.RLock()
+	routes := make([]*Route, 0, len(e.consumers))
+	for _, r := range e.consumers {
+		routes = append(routes, r)
 	}
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
+	e.RUnlock()
+	for _, r := range routes {
+		r.Run()
+		e.attach(ctx, r)
+	}
+}
 
-	if token.Error() != nil {
-		logger.Error(fmt.Sprintf("Client %s had error connecting to the broker: %v", e.id, token.Error()))
-		return nil, token.Error()
+func (e *exporter) validateSubject(sub string) bool {
+	if sub == "" {
+		return false
 	}
-	return client, nil
+	if strings.ContainsAny(sub, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(sub, ".")
+	for _, t := range tokens {
+		if len(t) == 0 {
+			return false
+		}
+	}
+	return true
 }
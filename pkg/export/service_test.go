@@ -0,0 +1,114 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const testHost = "tcp://localhost:1883"
+
+func TestRouteWorkers(t *testing.T) {
+	cases := []struct {
+		desc    string
+		workers int
+		want    int
+		err     error
+	}{
+		{
+			desc:    "default workers",
+			workers: 0,
+			want:    workers,
+		},
+		{
+			desc:    "configured workers",
+			workers: 5,
+			want:    5,
+		},
+		{
+			desc:    "negative workers",
+			workers: -1,
+			err:     errBadWorkers,
+		},
+	}
+	e := newTestExporter(0, config.MQTT{Host: testHost})
+	cfgs := map[string]config.MQTT{defaultBroker: {Host: testHost}}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rc := config.Route{Name: "r", NatsTopic: "channels", MqttTopic: "channels", Type: defaultType, Workers: tc.workers}
+			r, err := e.checkRoute(rc, cfgs)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Fatalf("expected error %s, got %v", tc.err, err)
+			case tc.err != nil:
+				// Reload rejects the route as invalid configuration.
+				c := config.Config{MQTT: config.MQTT{Host: testHost}, Routes: []config.Route{rc}}
+				if err := e.Reload(c); !errors.Contains(err, ErrInvalidConfig) {
+					t.Errorf("expected error %s, got %v", ErrInvalidConfig, err)
+				}
+				return
+			}
+			if r.Workers != tc.want || cap(r.Messages) != tc.want {
+				t.Errorf("expected %d workers, got %d with buffer of %d", tc.want, r.Workers, cap(r.Messages))
+			}
+		})
+	}
+}
+
+func TestStartInvalidRoutes(t *testing.T) {
+	valid := config.Route{Name: "valid", NatsTopic: "channels", MqttTopic: "channels", Type: defaultType}
+	cases := []struct {
+		desc   string
+		routes []config.Route
+		want   []config.Route
+		err    error
+	}{
+		{
+			desc:   "valid routes",
+			routes: []config.Route{valid},
+			want:   []config.Route{valid},
+		},
+		{
+			desc: "invalid routes dropped",
+			routes: []config.Route{
+				{Name: "workers", NatsTopic: "channels", MqttTopic: "channels", Type: defaultType, Workers: -1},
+				valid,
+				{Name: "broker", NatsTopic: "channels", MqttTopic: "channels", Type: defaultType, Broker: "unknown"},
+			},
+			want: []config.Route{valid},
+		},
+		{
+			desc:   "no valid routes",
+			routes: []config.Route{{Name: "subject", NatsTopic: "chan nels", MqttTopic: "channels", Type: defaultType}},
+			err:    errNoRoutesConfigured,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			e := newTestExporter(0, config.MQTT{Host: testHost})
+			e.streams = make(map[string]string)
+			e.done = make(chan struct{})
+			defer close(e.done)
+			e.cfg = config.Config{MQTT: config.MQTT{Host: testHost}, Routes: tc.routes}
+			err := e.Start(svcName)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.err != nil && !errors.Contains(err, tc.err):
+				t.Fatalf("expected error %s, got %v", tc.err, err)
+			case tc.err != nil:
+				return
+			}
+			if got := e.ListRoutes(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected routes %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
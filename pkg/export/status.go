@@ -0,0 +1,166 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"sync"
+	"time"
+)
+
+// Connection states.
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateDisconnected = "disconnected"
+)
+
+// Status contains the state of the export service.
+type Status struct {
+	Version   string           `json:"version"`
+	Commit    string           `json:"commit"`
+	BuildTime string           `json:"build_time"`
+	Brokers   []BrokerStatus   `json:"brokers"`
+	PubSub    ConnectionStatus `json:"pubsub"`
+	Routes    []RouteStatus    `json:"routes"`
+}
+
+// Ready checks if messages can flow from the message bus to all MQTT brokers.
+func (s Status) Ready() bool {
+	if s.PubSub.State != StateConnected {
+		return false
+	}
+	for _, b := range s.Brokers {
+		if b.State != StateConnected {
+			return false
+		}
+	}
+	return true
+}
+
+// BrokerStatus contains the state of the connection to MQTT broker.
+// Active is the host client is connected to.
+type BrokerStatus struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Active string `json:"active,omitempty"`
+	ConnectionStatus
+}
+
+// ConnectionStatus contains the state of the connection.
+type ConnectionStatus struct {
+	State            string     `json:"state"`
+	Attempts         int        `json:"connect_attempts,omitempty"`
+	LastConnected    *time.Time `json:"last_connected,omitempty"`
+	LastDisconnected *time.Time `json:"last_disconnected,omitempty"`
+	LastError        string     `json:"last_error,omitempty"`
+}
+
+// RouteStatus contains the state of the route. Queue is the number of
+// messages waiting for the workers and Buffered is the number of messages
+// stored in the route stream.
+type RouteStatus struct {
+	Name      string `json:"name"`
+	NatsTopic string `json:"nats_topic"`
+	MqttTopic string `json:"mqtt_topic"`
+	Broker    string `json:"broker"`
+	Type      string `json:"type"`
+	Direction string `json:"direction"`
+	Workers   int    `json:"workers"`
+	Queue     int    `json:"queue"`
+	Buffered  int64  `json:"buffered"`
+	// NatsSubject is set instead of MqttTopic for nats routes.
+	NatsSubject string `json:"nats_subject,omitempty"`
+}
+
+var states = []string{StateConnecting, StateConnected, StateReconnecting, StateDisconnected}
+
+// connection tracks the state of the connection.
+// Name is used as the label of the connection state metric.
+type connection struct {
+	name   string
+	status ConnectionStatus
+	// Set once the connection is closed, so it is no longer reported.
+	forgotten bool
+	mu        sync.RWMutex
+}
+
+func (c *connection) set(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	switch {
+	case state == StateConnected && c.status.State != StateConnected:
+		c.status.LastConnected = &now
+		c.status.Attempts = 0
+	case state != StateConnected && c.status.State == StateConnected:
+		c.status.LastDisconnected = &now
+	}
+	c.status.State = state
+	c.report()
+}
+
+func (c *connection) failed(state string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status.State == StateConnected {
+		now := time.Now()
+		c.status.LastDisconnected = &now
+	}
+	c.status.State = state
+	c.status.LastError = err.Error()
+	if state == StateConnecting {
+		c.status.Attempts++
+	}
+	c.report()
+}
+
+// report updates the connection state metric. Must be called with lock held.
+func (c *connection) report() {
+	if c.forgotten {
+		return
+	}
+	for _, s := range states {
+		v := 0.0
+		if s == c.status.State {
+			v = 1
+		}
+		connectionState.WithLabelValues(c.name, s).Set(v)
+	}
+}
+
+// mute stops reporting the connection state, keeping the metric as it is.
+func (c *connection) mute() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgotten = true
+}
+
+// forget removes the connection state metric.
+func (c *connection) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgotten = true
+	for _, s := range states {
+		connectionState.DeleteLabelValues(c.name, s)
+	}
+}
+
+func (c *connection) get() ConnectionStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// backoff returns the delay before the next connection attempt.
+func backoff(attempt int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mainflux/export/pkg/config"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+var _ messaging.MessageHandler = (*subscription)(nil)
+
+// subscription fans out messages received on the NATS subject
+// to all the routes subscribed to it.
+type subscription struct {
+	subject string
+	routes  []*Route
+	mu      sync.RWMutex
+}
+
+// Handle passes the message to the routes. Routes closed
+// while the message is dispatched are skipped.
+func (s *subscription) Handle(msg *messaging.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.routes {
+		if err := r.Handle(msg); err != nil && err != errRouteClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel is called when subject is unsubscribed.
+func (s *subscription) Cancel() error {
+	return nil
+}
+
+func (s *subscription) add(r *Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = append(s.routes, r)
+}
+
+// replace swaps the route in place, so messages are
+// not delivered to both routes.
+func (s *subscription) replace(old, r *Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.routes {
+		if o == old {
+			s.routes[i] = r
+			return
+		}
+	}
+	s.routes = append(s.routes, r)
+}
+
+// remove removes the route and returns the number of remaining routes.
+func (s *subscription) remove(r *Route) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.routes {
+		if o == r {
+			s.routes = append(s.routes[:i], s.routes[i+1:]...)
+			break
+		}
+	}
+	return len(s.routes)
+}
+
+// attach adds the route to the subscription of its NATS subject,
+// subscribing to the subject if it is the first route. Import routes
+// subscribe to their topic filter on MQTT broker instead.
+func (e *exporter) attach(ctx context.Context, r *Route) {
+	if r.Direction == config.DirectionImport {
+		e.subscribeBroker(r)
+		return
+	}
+	e.Lock()
+	s, ok := e.subs[r.NatsTopic]
+	if !ok {
+		s = &subscription{subject: r.NatsTopic}
+		e.subs[r.NatsTopic] = s
+	}
+	e.Unlock()
+	s.add(r)
+	if ok {
+		return
+	}
+	if err := e.pubsub.Subscribe(ctx, svcName, s.subject, s); err != nil {
+		e.logger.Error(fmt.Sprintf("Failed to subscribe to NATS %s: %s", s.subject, err))
+	}
+}
+
+// detach removes the route from the subscription of its NATS subject,
+// unsubscribing from the subject if it was the last route.
+// Subscriptions are changed only while reloadMu is held.
+func (e *exporter) detach(ctx context.Context, r *Route) {
+	if r.Direction == config.DirectionImport {
+		e.unsubscribeBroker(r)
+		return
+	}
+	e.RLock()
+	s, ok := e.subs[r.NatsTopic]
+	e.RUnlock()
+	// Removal waits for the message being dispatched, so it must not
+	// hold the lock the route workers need to publish the messages.
+	if !ok || s.remove(r) > 0 {
+		return
+	}
+	e.Lock()
+	delete(e.subs, r.NatsTopic)
+	e.Unlock()
+	if err := e.pubsub.Unsubscribe(ctx, svcName, s.subject); err != nil {
+		e.logger.Warn(fmt.Sprintf("Failed to unsubscribe from NATS %s: %s", s.subject, err))
+	}
+}
+
+// swap replaces the old route with the new one. If both routes
+// use the same NATS subject, subscription is kept.
+func (e *exporter) swap(ctx context.Context, old, r *Route) {
+	if old.NatsTopic != r.NatsTopic || old.Direction != r.Direction || r.Direction == config.DirectionImport {
+		e.attach(ctx, r)
+		e.detach(ctx, old)
+		return
+	}
+	e.RLock()
+	s, ok := e.subs[r.NatsTopic]
+	e.RUnlock()
+	if !ok {
+		e.attach(ctx, r)
+		return
+	}
+	s.replace(old, r)
+}
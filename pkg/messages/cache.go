@@ -0,0 +1,36 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import "errors"
+
+// ErrInvalidID indicates the message ID that the cache can't have issued.
+var ErrInvalidID = errors.New("invalid message id")
+
+// Entry is a single message stored in the stream.
+type Entry struct {
+	ID     string
+	Values map[string]interface{}
+}
+
+// Cache stores messages that failed to be published into per route streams,
+// so they can be republished later in the order they were stored.
+type Cache interface {
+	// Add appends message to the end of the stream and returns its ID.
+	Add(stream string, m map[string]interface{}) (string, error)
+
+	// Read returns up to count oldest messages from the stream.
+	Read(stream string, count int64) ([]Entry, error)
+
+	// Range returns up to count oldest messages with IDs from start to end,
+	// inclusive. Empty start and end stand for the start and the end of
+	// the stream.
+	Range(stream, start, end string, count int64) ([]Entry, error)
+
+	// Remove deletes messages with given IDs from the stream.
+	Remove(stream string, ids ...string) error
+
+	// Len returns number of messages in the stream.
+	Len(stream string) (int64, error)
+}
@@ -0,0 +1,531 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package file contains disk backed implementation of the messages cache.
+// Every stream is kept in its own directory as a sequence of append only
+// segment files and a checkpoint file that tracks removed messages.
+package file
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mainflux/export/pkg/messages"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	// Active segment is rotated once it grows over segmentSize.
+	segmentSize    = 8 * 1024 * 1024
+	segmentExt     = ".seg"
+	checkpointFile = "checkpoint"
+	// Record header contains length, checksum and sequence number.
+	headerSize = 4 + 4 + 8
+	dirPerm    = 0750
+	filePerm   = 0640
+
+	// Record data starting with valuesFormat holds length prefixed keys and values.
+	valuesFormat = 1
+)
+
+var (
+	_ messages.Cache = (*cache)(nil)
+
+	errCorruptedRecord = errors.New("corrupted record")
+	errMalformedValues = errors.New("malformed message values")
+	errOpenStream      = errors.New("failed to open stream")
+	errWriteCheckpoint = errors.New("failed to write checkpoint")
+)
+
+type cache struct {
+	dir     string
+	streams map[string]*queue
+	mu      sync.Mutex
+}
+
+// NewCache returns messages cache which stores streams in the directory dir.
+func NewCache(dir string) (messages.Cache, error) {
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+	c := &cache{
+		dir:     dir,
+		streams: make(map[string]*queue),
+	}
+	return c, nil
+}
+
+func (c *cache) Add(stream string, m map[string]interface{}) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, err := c.queue(stream)
+	if err != nil {
+		return "", err
+	}
+	seq, err := q.append(encode(m))
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(seq, 10), nil
+}
+
+func (c *cache) Read(stream string, count int64) ([]messages.Entry, error) {
+	return c.Range(stream, "", "", count)
+}
+
+func (c *cache) Range(stream, start, end string, count int64) ([]messages.Entry, error) {
+	from, to := uint64(0), uint64(math.MaxUint64)
+	var err error
+	if start != "" {
+		if from, err = strconv.ParseUint(start, 10, 64); err != nil {
+			return nil, errors.Wrap(messages.ErrInvalidID, err)
+		}
+	}
+	if end != "" {
+		if to, err = strconv.ParseUint(end, 10, 64); err != nil {
+			return nil, errors.Wrap(messages.ErrInvalidID, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, err := c.queue(stream)
+	if err != nil {
+		return nil, err
+	}
+	// Records are ordered by their sequence numbers.
+	i := sort.Search(len(q.records), func(i int) bool {
+		return q.records[i].seq >= from
+	})
+	var entries []messages.Entry
+	for _, r := range q.records[i:] {
+		if int64(len(entries)) >= count || r.seq > to {
+			break
+		}
+		if q.removed[r.seq] {
+			continue
+		}
+		data, err := q.read(r)
+		if err != nil {
+			return entries, err
+		}
+		values, err := decode(data)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, messages.Entry{
+			ID:     strconv.FormatUint(r.seq, 10),
+			Values: values,
+		})
+	}
+	return entries, nil
+}
+
+func (c *cache) Remove(stream string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, err := c.queue(stream)
+	if err != nil {
+		return err
+	}
+	seqs := make([]uint64, len(ids))
+	for i, id := range ids {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return errors.Wrap(messages.ErrInvalidID, err)
+		}
+		seqs[i] = seq
+	}
+	return q.remove(seqs...)
+}
+
+func (c *cache) Len(stream string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, err := c.queue(stream)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(q.records) - len(q.removed)), nil
+}
+
+// queue returns the stream queue, loading it from disk on first access.
+func (c *cache) queue(stream string) (*queue, error) {
+	if q, ok := c.streams[stream]; ok {
+		return q, nil
+	}
+	q, err := openQueue(filepath.Join(c.dir, url.PathEscape(stream)))
+	if err != nil {
+		return nil, errors.Wrap(errOpenStream, err)
+	}
+	c.streams[stream] = q
+	return q, nil
+}
+
+type record struct {
+	seq    uint64
+	seg    *segment
+	offset int64
+	size   int64
+}
+
+type segment struct {
+	id   uint64
+	path string
+	file *os.File
+	size int64
+}
+
+type checkpoint struct {
+	Head    uint64   `json:"head"`
+	Removed []uint64 `json:"removed,omitempty"`
+}
+
+// queue is a single stream stored on disk. Messages with sequence
+// number lower than head and the ones in removed set are deleted.
+type queue struct {
+	dir      string
+	segments []*segment
+	records  []record
+	removed  map[uint64]bool
+	head     uint64
+	next     uint64
+}
+
+func openQueue(dir string) (*queue, error) {
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+	q := &queue{
+		dir:     dir,
+		removed: make(map[uint64]bool),
+	}
+	if err := q.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	q.next = q.head
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := q.loadSegment(id, f)
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, seg)
+	}
+	stored := make(map[uint64]bool, len(q.records))
+	for _, r := range q.records {
+		stored[r.seq] = true
+	}
+	for seq := range q.removed {
+		if !stored[seq] {
+			delete(q.removed, seq)
+		}
+	}
+	q.advance()
+	if len(q.segments) == 0 {
+		if err := q.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return q, q.cleanup()
+}
+
+// loadSegment reads records from the segment file. Torn or corrupted
+// record ends the segment, so the file is truncated at its offset.
+func (q *queue) loadSegment(id uint64, path string) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, path: path, file: f}
+	var offset int64
+	for {
+		seq, size, err := readRecord(f, offset, info.Size(), nil)
+		if err != nil {
+			break
+		}
+		if seq >= q.head {
+			q.records = append(q.records, record{seq: seq, seg: seg, offset: offset, size: size})
+		}
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+		offset += size
+	}
+	if err := f.Truncate(offset); err != nil {
+		return nil, err
+	}
+	seg.size = offset
+	return seg, nil
+}
+
+func (q *queue) append(data []byte) (uint64, error) {
+	active := q.segments[len(q.segments)-1]
+	if active.size >= segmentSize {
+		if err := q.rotate(); err != nil {
+			return 0, err
+		}
+		active = q.segments[len(q.segments)-1]
+	}
+	seq := q.next
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint64(buf[8:16], seq)
+	copy(buf[headerSize:], data)
+	if _, err := active.file.WriteAt(buf, active.size); err != nil {
+		return 0, err
+	}
+	// Sync on every write so messages survive power loss.
+	if err := active.file.Sync(); err != nil {
+		return 0, err
+	}
+	q.records = append(q.records, record{seq: seq, seg: active, offset: active.size, size: int64(len(buf))})
+	active.size += int64(len(buf))
+	q.next++
+	return seq, nil
+}
+
+func (q *queue) read(r record) ([]byte, error) {
+	data := make([]byte, r.size-headerSize)
+	if _, _, err := readRecord(r.seg.file, r.offset, r.seg.size, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (q *queue) remove(seqs ...uint64) error {
+	for _, seq := range seqs {
+		if seq >= q.head && seq < q.next {
+			q.removed[seq] = true
+		}
+	}
+	q.advance()
+	if err := q.saveCheckpoint(); err != nil {
+		return errors.Wrap(errWriteCheckpoint, err)
+	}
+	return q.cleanup()
+}
+
+// advance moves head over the removed messages at the start of the queue.
+func (q *queue) advance() {
+	i := 0
+	for ; i < len(q.records) && q.removed[q.records[i].seq]; i++ {
+		delete(q.removed, q.records[i].seq)
+	}
+	q.records = q.records[i:]
+	if len(q.records) > 0 {
+		q.head = q.records[0].seq
+		return
+	}
+	q.head = q.next
+}
+
+// cleanup deletes segments that contain only removed messages.
+// Empty active segment is reused instead.
+func (q *queue) cleanup() error {
+	for len(q.segments) > 1 {
+		seg := q.segments[0]
+		if len(q.records) > 0 && q.records[0].seg == seg {
+			break
+		}
+		if err := seg.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.records) == 0 && q.segments[0].size >= segmentSize {
+		return q.rotate()
+	}
+	return nil
+}
+
+func (q *queue) rotate() error {
+	var id uint64
+	if n := len(q.segments); n > 0 {
+		id = q.segments[n-1].id + 1
+	}
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, &segment{id: id, path: path, file: f})
+	return syncDir(q.dir)
+}
+
+func (q *queue) loadCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(q.dir, checkpointFile))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+	q.head = cp.Head
+	for _, seq := range cp.Removed {
+		q.removed[seq] = true
+	}
+	return nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint file.
+func (q *queue) saveCheckpoint() error {
+	cp := checkpoint{Head: q.head}
+	for seq := range q.removed {
+		cp.Removed = append(cp.Removed, seq)
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.dir, checkpointFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// encode encodes the message values as length prefixed keys and values,
+// so binary values are stored as they are. Values other than strings and
+// byte slices are formatted, the same way Redis stores them.
+func encode(m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	data := []byte{valuesFormat}
+	for _, k := range keys {
+		var v string
+		switch val := m[k].(type) {
+		case string:
+			v = val
+		case []byte:
+			v = string(val)
+		default:
+			v = fmt.Sprint(val)
+		}
+		data = binary.AppendUvarint(data, uint64(len(k)))
+		data = append(data, k...)
+		data = binary.AppendUvarint(data, uint64(len(v)))
+		data = append(data, v...)
+	}
+	return data
+}
+
+// decode decodes the message values, which are returned as strings.
+func decode(data []byte) (map[string]interface{}, error) {
+	if len(data) == 0 || data[0] != valuesFormat {
+		return nil, errMalformedValues
+	}
+	data = data[1:]
+	values := make(map[string]interface{})
+	next := func() (string, error) {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return "", errMalformedValues
+		}
+		v := string(data[n : n+int(l)])
+		data = data[n+int(l):]
+		return v, nil
+	}
+	for len(data) > 0 {
+		k, err := next()
+		if err != nil {
+			return nil, err
+		}
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// readRecord reads record at the offset and returns its sequence number
+// and total size. Record must end before the limit. If data is not nil,
+// record data is read into it.
+func readRecord(f *os.File, offset, limit int64, data []byte) (uint64, int64, error) {
+	if offset+headerSize > limit {
+		return 0, 0, io.EOF
+	}
+	var hdr [headerSize]byte
+	if _, err := f.ReadAt(hdr[:], offset); err != nil {
+		return 0, 0, err
+	}
+	l := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	seq := binary.BigEndian.Uint64(hdr[8:16])
+	if offset+headerSize+int64(l) > limit {
+		return 0, 0, errCorruptedRecord
+	}
+	if data == nil || len(data) != int(l) {
+		data = make([]byte, l)
+	}
+	if _, err := f.ReadAt(data, offset+headerSize); err != nil {
+		return 0, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return 0, 0, errCorruptedRecord
+	}
+	return seq, headerSize + int64(l), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
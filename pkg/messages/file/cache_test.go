@@ -0,0 +1,287 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mainflux/export/pkg/messages"
+)
+
+const stream = "export.test"
+
+func newCache(t *testing.T, dir string) messages.Cache {
+	t.Helper()
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return c
+}
+
+func TestAddRead(t *testing.T) {
+	cases := []struct {
+		desc   string
+		values map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			desc:   "text payload",
+			values: map[string]interface{}{"topic": "channels/1/messages", "payload": `[{"n":"temp","v":21}]`},
+			want:   map[string]interface{}{"topic": "channels/1/messages", "payload": `[{"n":"temp","v":21}]`},
+		},
+		{
+			desc:   "binary payload",
+			values: map[string]interface{}{"topic": "t", "payload": string([]byte{0x0a, 0xff, 0xfe, 0x80, 0x01})},
+			want:   map[string]interface{}{"topic": "t", "payload": string([]byte{0x0a, 0xff, 0xfe, 0x80, 0x01})},
+		},
+		{
+			desc:   "byte slice payload",
+			values: map[string]interface{}{"topic": "t", "payload": []byte{0x00, 0xc3, 0x28}},
+			want:   map[string]interface{}{"topic": "t", "payload": string([]byte{0x00, 0xc3, 0x28})},
+		},
+		{
+			desc:   "empty payload",
+			values: map[string]interface{}{"topic": "t", "payload": ""},
+			want:   map[string]interface{}{"topic": "t", "payload": ""},
+		},
+		{
+			desc:   "formatted values",
+			values: map[string]interface{}{"topic": "t", "qos": 1, "retain": true},
+			want:   map[string]interface{}{"topic": "t", "qos": "1", "retain": "true"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			c := newCache(t, dir)
+			id, err := c.Add(stream, tc.values)
+			if err != nil {
+				t.Fatalf("unexpected error adding message: %s", err)
+			}
+			// Cache opened again reads the messages from disk.
+			for i, c := range []messages.Cache{c, newCache(t, dir)} {
+				entries, err := c.Read(stream, 10)
+				if err != nil {
+					t.Fatalf("read %d: unexpected error: %s", i, err)
+				}
+				if len(entries) != 1 {
+					t.Fatalf("read %d: expected 1 entry, got %d", i, len(entries))
+				}
+				if entries[0].ID != id {
+					t.Errorf("read %d: expected ID %s, got %s", i, id, entries[0].ID)
+				}
+				if !reflect.DeepEqual(entries[0].Values, tc.want) {
+					t.Errorf("read %d: expected values %q, got %q", i, tc.want, entries[0].Values)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	qos := byte(1)
+	m := messages.Msg{
+		Topic:       "channels/1/messages",
+		Payload:     string([]byte{0x0a, 0xff, 0xfe, 0x80, 0x01}),
+		Created:     1690000000000000000,
+		Origin:      1690000000000000001,
+		QoS:         &qos,
+		ContentType: "application/octet-stream",
+		Properties:  map[string]string{"publisher": "thing"},
+	}
+	c := newCache(t, t.TempDir())
+	if _, err := c.Add(stream, m.Encode()); err != nil {
+		t.Fatalf("unexpected error adding message: %s", err)
+	}
+	entries, err := c.Read(stream, 1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d: %v", len(entries), err)
+	}
+	var got messages.Msg
+	if err := got.Decode(entries[0].Values); err != nil {
+		t.Fatalf("unexpected error decoding message: %s", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("expected message %+v, got %+v", m, got)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	cases := []struct {
+		desc   string
+		add    int
+		remove []int
+		want   []int
+	}{
+		{
+			desc:   "remove head",
+			add:    3,
+			remove: []int{0},
+			want:   []int{1, 2},
+		},
+		{
+			desc:   "remove batch",
+			add:    5,
+			remove: []int{0, 1, 2},
+			want:   []int{3, 4},
+		},
+		{
+			desc:   "remove out of order",
+			add:    5,
+			remove: []int{3, 1},
+			want:   []int{0, 2, 4},
+		},
+		{
+			desc:   "remove all",
+			add:    4,
+			remove: []int{2, 0, 3, 1},
+			want:   []int{},
+		},
+		{
+			desc:   "remove nothing",
+			add:    2,
+			remove: []int{},
+			want:   []int{0, 1},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			c := newCache(t, dir)
+			ids := make([]string, tc.add)
+			for i := range ids {
+				id, err := c.Add(stream, map[string]interface{}{"payload": fmt.Sprint(i)})
+				if err != nil {
+					t.Fatalf("unexpected error adding message: %s", err)
+				}
+				ids[i] = id
+			}
+			rm := make([]string, len(tc.remove))
+			for i, n := range tc.remove {
+				rm[i] = ids[n]
+			}
+			if err := c.Remove(stream, rm...); err != nil {
+				t.Fatalf("unexpected error removing messages: %s", err)
+			}
+			for i, c := range []messages.Cache{c, newCache(t, dir)} {
+				checkStream(t, fmt.Sprintf("read %d", i), c, ids, tc.want)
+			}
+		})
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := c.Add(stream, map[string]interface{}{"payload": fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := c.Remove(stream, ids[0]); err != nil {
+		t.Fatalf("unexpected error removing message: %s", err)
+	}
+
+	// Messages added after restart continue the sequence.
+	c = newCache(t, dir)
+	id, err := c.Add(stream, map[string]interface{}{"payload": "3"})
+	if err != nil {
+		t.Fatalf("unexpected error adding message: %s", err)
+	}
+	ids = append(ids, id)
+	if len(map[string]bool{ids[0]: true, ids[1]: true, ids[2]: true, ids[3]: true}) != 4 {
+		t.Fatalf("expected unique IDs, got %v", ids)
+	}
+	checkStream(t, "after restart", newCache(t, dir), ids, []int{1, 2, 3})
+}
+
+func TestRange(t *testing.T) {
+	c := newCache(t, t.TempDir())
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := c.Add(stream, map[string]interface{}{"payload": fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := c.Remove(stream, ids[2]); err != nil {
+		t.Fatalf("unexpected error removing message: %s", err)
+	}
+	cases := []struct {
+		desc  string
+		start string
+		end   string
+		count int64
+		want  []int
+		err   bool
+	}{
+		{desc: "whole stream", count: 10, want: []int{0, 1, 3, 4}},
+		{desc: "count", count: 2, want: []int{0, 1}},
+		{desc: "from start", start: ids[1], count: 10, want: []int{1, 3, 4}},
+		{desc: "to end", end: ids[3], count: 10, want: []int{0, 1, 3}},
+		{desc: "single message", start: ids[3], end: ids[3], count: 10, want: []int{3}},
+		{desc: "removed message", start: ids[2], end: ids[2], count: 10, want: []int{}},
+		{desc: "invalid ID", start: "first", count: 10, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			entries, err := c.Range(stream, tc.start, tc.end, tc.count)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := []string{}
+			for _, en := range entries {
+				got = append(got, en.ID)
+			}
+			want := []string{}
+			for _, n := range tc.want {
+				want = append(want, ids[n])
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected IDs %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+// checkStream checks that the stream contains the messages added
+// with IDs at the want indexes, in order.
+func checkStream(t *testing.T, desc string, c messages.Cache, ids []string, want []int) {
+	t.Helper()
+	n, err := c.Len(stream)
+	if err != nil {
+		t.Fatalf("%s: unexpected error reading length: %s", desc, err)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("%s: expected length %d, got %d", desc, len(want), n)
+	}
+	entries, err := c.Read(stream, int64(len(ids)))
+	if err != nil {
+		t.Fatalf("%s: unexpected error reading stream: %s", desc, err)
+	}
+	got := make([]string, len(entries))
+	for i, en := range entries {
+		got[i] = en.ID
+	}
+	exp := make([]string, len(want))
+	for i, n := range want {
+		exp[i] = ids[n]
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("%s: expected IDs %v, got %v", desc, exp, got)
+	}
+}
@@ -3,7 +3,11 @@
 
 package messages
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
 
 type message interface {
 	Encode() map[string]interface{}
@@ -16,23 +20,125 @@ var (
 	errIncorrectMsgData = errors.New("incorrect message data")
 )
 
+// Msg is a message stored in the stream. Created is the Unix time
+// in nanoseconds when the message was stored and Origin is the Unix
+// time in nanoseconds when the message was created at its source,
+// or 0 if unknown. QoS and Retain are set if the message overrides
+// the publisher defaults. Expiry is in nanoseconds, counted from Created.
+// Key identifies the channel and subtopic of the message and Source
+// is the encoded message the payload was produced from, if set.
 type Msg struct {
-	Topic   string
-	Payload string
+	Topic       string
+	Payload     string
+	Created     int64
+	Origin      int64
+	QoS         *byte
+	Retain      *bool
+	ContentType string
+	Expiry      int64
+	Properties  map[string]string
+	Key         string
+	Source      string
 }
 
 func (m *Msg) Encode() map[string]interface{} {
-	return map[string]interface{}{
+	ret := map[string]interface{}{
 		"topic":   m.Topic,
 		"payload": m.Payload,
+		"created": strconv.FormatInt(m.Created, 10),
+		"origin":  strconv.FormatInt(m.Origin, 10),
+	}
+	if m.QoS != nil {
+		ret["qos"] = strconv.Itoa(int(*m.QoS))
+	}
+	if m.Retain != nil {
+		ret["retain"] = strconv.FormatBool(*m.Retain)
+	}
+	if m.ContentType != "" {
+		ret["content_type"] = m.ContentType
+	}
+	if m.Expiry != 0 {
+		ret["expiry"] = strconv.FormatInt(m.Expiry, 10)
 	}
+	if m.Key != "" {
+		ret["key"] = m.Key
+	}
+	if m.Source != "" {
+		ret["source"] = m.Source
+	}
+	if len(m.Properties) > 0 {
+		// Properties are marshaled so that all the values are strings.
+		if b, err := json.Marshal(m.Properties); err == nil {
+			ret["properties"] = string(b)
+		}
+	}
+	return ret
 }
 
 func (m *Msg) Decode(in map[string]interface{}) error {
-	if len(in) < 2 {
+	topic, ok := in["topic"].(string)
+	if !ok {
+		return errIncorrectMsgData
+	}
+	payload, ok := in["payload"].(string)
+	if !ok {
 		return errIncorrectMsgData
 	}
-	m.Topic = in["topic"].(string)
-	m.Payload = in["payload"].(string)
+	m.Topic = topic
+	m.Payload = payload
+	// Messages stored by the older versions have no timestamps.
+	created, err := optionalInt(in, "created")
+	if err != nil {
+		return err
+	}
+	origin, err := optionalInt(in, "origin")
+	if err != nil {
+		return err
+	}
+	expiry, err := optionalInt(in, "expiry")
+	if err != nil {
+		return err
+	}
+	m.Created = created
+	m.Origin = origin
+	m.Expiry = expiry
+	m.ContentType, _ = in["content_type"].(string)
+	m.Key, _ = in["key"].(string)
+	m.Source, _ = in["source"].(string)
+	m.Properties = nil
+	if p, ok := in["properties"].(string); ok {
+		if err := json.Unmarshal([]byte(p), &m.Properties); err != nil {
+			return errIncorrectMsgData
+		}
+	}
+	m.QoS = nil
+	if q, ok := in["qos"].(string); ok {
+		qos, err := strconv.ParseUint(q, 10, 8)
+		if err != nil {
+			return errIncorrectMsgData
+		}
+		b := byte(qos)
+		m.QoS = &b
+	}
+	m.Retain = nil
+	if r, ok := in["retain"].(string); ok {
+		retain, err := strconv.ParseBool(r)
+		if err != nil {
+			return errIncorrectMsgData
+		}
+		m.Retain = &retain
+	}
 	return nil
 }
+
+func optionalInt(in map[string]interface{}, key string) (int64, error) {
+	v, ok := in[key].(string)
+	if !ok {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errIncorrectMsgData
+	}
+	return i, nil
+}
@@ -2,7 +2,97 @@
 // SPDX-License-Identifier: Apache-2.0
 package messages
 
+import "time"
+
 type Publisher interface {
 	// Publish message to topic, save into stream if publish fails
-	Publish(stream string, topic string, msg []byte) error
+	Publish(stream string, topic string, msg []byte, opts ...Option) error
+}
+
+// Options contains per message publishing options.
+type Options struct {
+	// Created is the time when message was created at its source.
+	Created time.Time
+	// QoS and Retain override the publisher defaults when set.
+	QoS    *byte
+	Retain *bool
+	// ContentType, Expiry and Properties are sent
+	// only by the publishers that support them.
+	ContentType string
+	Expiry      time.Duration
+	Properties  map[string]string
+	// Key identifies the channel and subtopic of the message,
+	// so only the latest message per key can be buffered.
+	Key string
+	// Source is the encoded message the payload was produced from,
+	// which is dead-lettered if the target rejects the message.
+	Source []byte
+}
+
+// Option sets the publishing option.
+type Option func(*Options)
+
+// WithCreated sets the time when message was created at its source.
+func WithCreated(t time.Time) Option {
+	return func(o *Options) {
+		o.Created = t
+	}
+}
+
+// WithQoS sets the QoS of the published message.
+func WithQoS(qos byte) Option {
+	return func(o *Options) {
+		o.QoS = &qos
+	}
+}
+
+// WithRetain sets the retain flag of the published message.
+func WithRetain(retain bool) Option {
+	return func(o *Options) {
+		o.Retain = &retain
+	}
+}
+
+// WithContentType sets the content type of the message.
+func WithContentType(ct string) Option {
+	return func(o *Options) {
+		o.ContentType = ct
+	}
+}
+
+// WithExpiry sets the time after which the message is no longer delivered.
+func WithExpiry(d time.Duration) Option {
+	return func(o *Options) {
+		o.Expiry = d
+	}
+}
+
+// WithProperties sets the properties describing the message.
+func WithProperties(p map[string]string) Option {
+	return func(o *Options) {
+		o.Properties = p
+	}
+}
+
+// WithKey sets the key of the message.
+func WithKey(key string) Option {
+	return func(o *Options) {
+		o.Key = key
+	}
+}
+
+// WithSource sets the encoded message the payload was produced from.
+func WithSource(src []byte) Option {
+	return func(o *Options) {
+		o.Source = src
+	}
+}
+
+// NewOptions returns options with opts applied.
+func NewOptions(opts ...Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
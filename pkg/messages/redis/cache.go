@@ -0,0 +1,85 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package redis contains Redis stream implementation of the messages cache.
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mainflux/export/pkg/messages"
+)
+
+var _ messages.Cache = (*cache)(nil)
+
+type cache struct {
+	client *redis.Client
+}
+
+// NewCache returns Redis stream backed messages cache.
+func NewCache(client *redis.Client) messages.Cache {
+	return &cache{client: client}
+}
+
+func (c *cache) Add(stream string, m map[string]interface{}) (string, error) {
+	args := &redis.XAddArgs{
+		Stream: stream,
+		Values: m,
+	}
+	return c.client.XAdd(context.Background(), args).Result()
+}
+
+func (c *cache) Read(stream string, count int64) ([]messages.Entry, error) {
+	return c.Range(stream, "", "", count)
+}
+
+func (c *cache) Range(stream, start, end string, count int64) ([]messages.Entry, error) {
+	for _, id := range []string{start, end} {
+		if id != "" && !validID(id) {
+			return nil, messages.ErrInvalidID
+		}
+	}
+	if start == "" {
+		start = "-"
+	}
+	if end == "" {
+		end = "+"
+	}
+	msgs, err := c.client.XRangeN(context.Background(), stream, start, end, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]messages.Entry, len(msgs))
+	for i, m := range msgs {
+		entries[i] = messages.Entry{ID: m.ID, Values: m.Values}
+	}
+	return entries, nil
+}
+
+func (c *cache) Remove(stream string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return c.client.XDel(context.Background(), stream, ids...).Err()
+}
+
+func (c *cache) Len(stream string) (int64, error) {
+	return c.client.XLen(context.Background(), stream).Result()
+}
+
+// validID checks if the ID has <milliseconds>-<sequence> format
+// of the stream entry IDs, or the milliseconds only.
+func validID(id string) bool {
+	ms, seq, ok := strings.Cut(id, "-")
+	if _, err := strconv.ParseUint(ms, 10, 64); err != nil {
+		return false
+	}
+	if !ok {
+		return true
+	}
+	_, err := strconv.ParseUint(seq, 10, 64)
+	return err == nil
+}
@@ -0,0 +1,364 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Overflow tells which messages are dropped when stream reaches its size limit.
+type Overflow string
+
+const (
+	// DropOldest removes the oldest messages to make room for the new one.
+	DropOldest Overflow = "drop_oldest"
+	// DropNewest drops the new message.
+	DropNewest Overflow = "drop_newest"
+	// KeepLatest removes the older messages with the same key as the new
+	// one, so only the latest value per channel and subtopic is kept.
+	// If that's not enough, the oldest messages are removed.
+	KeepLatest Overflow = "keep_latest"
+)
+
+// Number of messages read at once while indexing the stream.
+const loadBatch = 1000
+
+// Reasons for dropping the messages.
+const (
+	ReasonOverflow = "overflow"
+	ReasonExpired  = "expired"
+)
+
+var (
+	_ Cache = (*RetentionCache)(nil)
+
+	// ErrUnknownOverflow indicates unsupported overflow policy.
+	ErrUnknownOverflow = errors.New("unknown overflow policy")
+	// ErrDropped indicates that the new message was dropped
+	// instead of being stored, because the stream is full.
+	ErrDropped = errors.New("message dropped by retention")
+)
+
+// Retention limits the size of the stream and the age of its messages.
+// Zero value means no limit.
+type Retention struct {
+	MaxSize  int64
+	MaxAge   time.Duration
+	Overflow Overflow
+}
+
+// Validate checks if retention is correct.
+func (r Retention) Validate() error {
+	switch r.Overflow {
+	case "", DropOldest, DropNewest, KeepLatest:
+		return nil
+	default:
+		return ErrUnknownOverflow
+	}
+}
+
+// DropFunc is called with the number of messages dropped from the stream.
+type DropFunc func(stream, reason string, count int)
+
+// RetentionCache applies retention to the streams of the underlying cache.
+type RetentionCache struct {
+	cache   Cache
+	onDrop  DropFunc
+	streams map[string]*retained
+	mu      sync.Mutex
+}
+
+type retained struct {
+	Retention
+	size    int64
+	entries *list.List
+	ids     map[string]*list.Element
+	latest  map[string]*list.Element
+}
+
+// indexed is the stored message. Key is the key of the message,
+// or its topic for messages stored without one.
+type indexed struct {
+	id      string
+	key     string
+	size    int64
+	created time.Time
+}
+
+// NewRetentionCache wraps the cache and applies retention set per stream.
+func NewRetentionCache(c Cache, onDrop DropFunc) *RetentionCache {
+	return &RetentionCache{
+		cache:   c,
+		onDrop:  onDrop,
+		streams: make(map[string]*retained),
+	}
+}
+
+// SetRetention sets the retention of the stream and applies it immediately.
+func (rc *RetentionCache) SetRetention(stream string, r Retention) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if r.MaxSize == 0 && r.MaxAge == 0 {
+		delete(rc.streams, stream)
+		return nil
+	}
+	s, ok := rc.streams[stream]
+	if !ok {
+		var err error
+		if s, err = rc.load(stream); err != nil {
+			return err
+		}
+		rc.streams[stream] = s
+	}
+	s.Retention = r
+	if err := rc.expire(stream, s); err != nil {
+		return err
+	}
+	for s.MaxSize > 0 && s.size > s.MaxSize && s.entries.Len() > 0 {
+		if err := rc.dropOldest(stream, s, ReasonOverflow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add stores the message, applying the retention of the stream. If the
+// message is dropped by DropNewest overflow, ErrDropped is returned.
+func (rc *RetentionCache) Add(stream string, m map[string]interface{}) (string, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	s, ok := rc.streams[stream]
+	if !ok {
+		return rc.cache.Add(stream, m)
+	}
+	e, err := index("", m)
+	if err != nil {
+		return "", err
+	}
+	if err := rc.expire(stream, s); err != nil {
+		return "", err
+	}
+	if s.MaxSize > 0 && s.size+e.size > s.MaxSize {
+		if s.Overflow == DropNewest {
+			rc.dropped(stream, ReasonOverflow, 1)
+			return "", ErrDropped
+		}
+		if err := rc.makeRoom(stream, s, e); err != nil {
+			return "", err
+		}
+	}
+	id, err := rc.cache.Add(stream, m)
+	if err != nil {
+		return "", err
+	}
+	e.id = id
+	s.push(e)
+	return id, nil
+}
+
+func (rc *RetentionCache) Read(stream string, count int64) ([]Entry, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if s, ok := rc.streams[stream]; ok {
+		if err := rc.expire(stream, s); err != nil {
+			return nil, err
+		}
+	}
+	return rc.cache.Read(stream, count)
+}
+
+func (rc *RetentionCache) Range(stream, start, end string, count int64) ([]Entry, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if s, ok := rc.streams[stream]; ok {
+		if err := rc.expire(stream, s); err != nil {
+			return nil, err
+		}
+	}
+	return rc.cache.Range(stream, start, end, count)
+}
+
+func (rc *RetentionCache) Remove(stream string, ids ...string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := rc.cache.Remove(stream, ids...); err != nil {
+		return err
+	}
+	if s, ok := rc.streams[stream]; ok {
+		for _, id := range ids {
+			if el, ok := s.ids[id]; ok {
+				s.remove(el)
+			}
+		}
+	}
+	return nil
+}
+
+func (rc *RetentionCache) Len(stream string) (int64, error) {
+	return rc.cache.Len(stream)
+}
+
+// load builds the index of messages already stored in the stream. Stream
+// is read in pages of loadBatch messages, so the backlog is not loaded
+// into memory at once.
+func (rc *RetentionCache) load(stream string) (*retained, error) {
+	s := &retained{
+		entries: list.New(),
+		ids:     make(map[string]*list.Element),
+		latest:  make(map[string]*list.Element),
+	}
+	last := ""
+	for {
+		entries, err := rc.cache.Range(stream, last, "", loadBatch)
+		if err != nil {
+			return nil, err
+		}
+		n := len(entries)
+		// Range includes the last message of the previous page.
+		if last != "" && n > 0 && entries[0].ID == last {
+			entries = entries[1:]
+		}
+		for _, en := range entries {
+			e, err := index(en.ID, en.Values)
+			if err != nil {
+				continue
+			}
+			s.push(e)
+		}
+		if n < loadBatch || len(entries) == 0 {
+			return s, nil
+		}
+		last = entries[len(entries)-1].ID
+	}
+}
+
+// makeRoom removes messages until the new one fits into the stream.
+func (rc *RetentionCache) makeRoom(stream string, s *retained, e indexed) error {
+	if s.Overflow == KeepLatest {
+		// Older messages with the same key are replaced by the new one.
+		err := rc.dropWhere(stream, s, func(el *list.Element) bool {
+			return el.Value.(indexed).key == e.key
+		})
+		if err != nil {
+			return err
+		}
+		if s.size+e.size > s.MaxSize {
+			// Messages which have a newer message with the same key.
+			err := rc.dropWhere(stream, s, func(el *list.Element) bool {
+				return s.latest[el.Value.(indexed).key] != el
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for s.size+e.size > s.MaxSize && s.entries.Len() > 0 {
+		if err := rc.dropOldest(stream, s, ReasonOverflow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropWhere removes all messages for which drop returns true at once.
+func (rc *RetentionCache) dropWhere(stream string, s *retained, drop func(*list.Element) bool) error {
+	var ids []string
+	var els []*list.Element
+	for el := s.entries.Front(); el != nil; el = el.Next() {
+		if drop(el) {
+			ids = append(ids, el.Value.(indexed).id)
+			els = append(els, el)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := rc.cache.Remove(stream, ids...); err != nil {
+		return err
+	}
+	for _, el := range els {
+		s.remove(el)
+	}
+	rc.dropped(stream, ReasonOverflow, len(ids))
+	return nil
+}
+
+// expire removes messages older than max age.
+func (rc *RetentionCache) expire(stream string, s *retained) error {
+	if s.MaxAge == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-s.MaxAge)
+	for {
+		el := s.entries.Front()
+		if el == nil || !el.Value.(indexed).created.Before(deadline) {
+			return nil
+		}
+		if err := rc.drop(stream, s, el, ReasonExpired); err != nil {
+			return err
+		}
+	}
+}
+
+func (rc *RetentionCache) dropOldest(stream string, s *retained, reason string) error {
+	return rc.drop(stream, s, s.entries.Front(), reason)
+}
+
+func (rc *RetentionCache) drop(stream string, s *retained, el *list.Element, reason string) error {
+	if err := rc.cache.Remove(stream, el.Value.(indexed).id); err != nil {
+		return err
+	}
+	s.remove(el)
+	rc.dropped(stream, reason, 1)
+	return nil
+}
+
+func (rc *RetentionCache) dropped(stream, reason string, count int) {
+	if rc.onDrop != nil {
+		rc.onDrop(stream, reason, count)
+	}
+}
+
+func (s *retained) push(e indexed) {
+	el := s.entries.PushBack(e)
+	s.ids[e.id] = el
+	s.latest[e.key] = el
+	s.size += e.size
+}
+
+func (s *retained) remove(el *list.Element) {
+	e := s.entries.Remove(el).(indexed)
+	delete(s.ids, e.id)
+	if s.latest[e.key] == el {
+		delete(s.latest, e.key)
+	}
+	s.size -= e.size
+}
+
+func index(id string, values map[string]interface{}) (indexed, error) {
+	var m Msg
+	if err := m.Decode(values); err != nil {
+		return indexed{}, err
+	}
+	created := time.Now()
+	if m.Created > 0 {
+		created = time.Unix(0, m.Created)
+	}
+	e := indexed{
+		id:      id,
+		key:     m.Key,
+		size:    int64(len(m.Topic) + len(m.Payload) + len(m.Source)),
+		created: created,
+	}
+	if e.key == "" {
+		e.key = m.Topic
+	}
+	return e, nil
+}
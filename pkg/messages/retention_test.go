@@ -0,0 +1,356 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const stream = "export.test"
+
+var _ Cache = (*memCache)(nil)
+
+// memCache is in-memory cache keeping the messages in the order they are added.
+// Largest number of messages read at once is tracked in maxRead.
+type memCache struct {
+	next    int
+	entries map[string][]Entry
+	maxRead int64
+}
+
+func newMemCache() *memCache {
+	return &memCache{entries: make(map[string][]Entry)}
+}
+
+func (c *memCache) Add(stream string, m map[string]interface{}) (string, error) {
+	id := strconv.Itoa(c.next)
+	c.next++
+	c.entries[stream] = append(c.entries[stream], Entry{ID: id, Values: m})
+	return id, nil
+}
+
+func (c *memCache) Read(stream string, count int64) ([]Entry, error) {
+	return c.Range(stream, "", "", count)
+}
+
+func (c *memCache) Range(stream, start, end string, count int64) ([]Entry, error) {
+	if count > c.maxRead {
+		c.maxRead = count
+	}
+	ret := []Entry{}
+	for _, en := range c.entries[stream] {
+		id, _ := strconv.Atoi(en.ID)
+		if int64(len(ret)) >= count {
+			break
+		}
+		if from, err := strconv.Atoi(start); err == nil && id < from {
+			continue
+		}
+		if to, err := strconv.Atoi(end); err == nil && id > to {
+			break
+		}
+		ret = append(ret, en)
+	}
+	return ret, nil
+}
+
+func (c *memCache) Remove(stream string, ids ...string) error {
+	rm := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		rm[id] = true
+	}
+	var kept []Entry
+	for _, en := range c.entries[stream] {
+		if !rm[en.ID] {
+			kept = append(kept, en)
+		}
+	}
+	c.entries[stream] = kept
+	return nil
+}
+
+func (c *memCache) Len(stream string) (int64, error) {
+	return int64(len(c.entries[stream])), nil
+}
+
+// payloads returns the payloads of the messages in the stream.
+func (c *memCache) payloads(stream string) []string {
+	ret := []string{}
+	for _, en := range c.entries[stream] {
+		var m Msg
+		if err := m.Decode(en.Values); err == nil {
+			ret = append(ret, m.Payload)
+		}
+	}
+	return ret
+}
+
+// stored is the message stored in the stream, created age ago.
+type stored struct {
+	key     string
+	payload string
+	age     time.Duration
+}
+
+func (m stored) encode() map[string]interface{} {
+	msg := Msg{
+		Topic:   "t",
+		Payload: m.payload,
+		Created: time.Now().Add(-m.age).UnixNano(),
+		Key:     m.key,
+	}
+	return msg.Encode()
+}
+
+func TestRetention(t *testing.T) {
+	// Every message takes 2 bytes, 1 for the topic and 1 for the payload.
+	cases := []struct {
+		desc      string
+		retention Retention
+		msgs      []stored
+		want      []string
+		dropped   int
+		errs      int
+	}{
+		{
+			desc:      "no limits",
+			retention: Retention{},
+			msgs:      []stored{{payload: "a"}, {payload: "b"}, {payload: "c"}},
+			want:      []string{"a", "b", "c"},
+		},
+		{
+			desc:      "drop oldest",
+			retention: Retention{MaxSize: 4, Overflow: DropOldest},
+			msgs:      []stored{{payload: "a"}, {payload: "b"}, {payload: "c"}},
+			want:      []string{"b", "c"},
+			dropped:   1,
+		},
+		{
+			desc:      "drop oldest by default",
+			retention: Retention{MaxSize: 4},
+			msgs:      []stored{{payload: "a"}, {payload: "b"}, {payload: "c"}, {payload: "d"}},
+			want:      []string{"c", "d"},
+			dropped:   2,
+		},
+		{
+			desc:      "drop newest",
+			retention: Retention{MaxSize: 4, Overflow: DropNewest},
+			msgs:      []stored{{payload: "a"}, {payload: "b"}, {payload: "c"}, {payload: "d"}},
+			want:      []string{"a", "b"},
+			dropped:   2,
+			errs:      2,
+		},
+		{
+			desc:      "keep latest per key",
+			retention: Retention{MaxSize: 6, Overflow: KeepLatest},
+			msgs: []stored{
+				{key: "1.temp", payload: "a"},
+				{key: "1.hum", payload: "b"},
+				{key: "1.temp", payload: "c"},
+				{key: "1.temp", payload: "d"},
+			},
+			want:    []string{"b", "d"},
+			dropped: 2,
+		},
+		{
+			desc:      "keep latest compacts",
+			retention: Retention{MaxSize: 6, Overflow: KeepLatest},
+			msgs: []stored{
+				{key: "1.temp", payload: "a"},
+				{key: "1.temp", payload: "b"},
+				{key: "1.hum", payload: "c"},
+				{key: "1.hum", payload: "d"},
+				{key: "2", payload: "e"},
+			},
+			want:    []string{"b", "d", "e"},
+			dropped: 2,
+		},
+		{
+			desc:      "keep latest drops oldest",
+			retention: Retention{MaxSize: 4, Overflow: KeepLatest},
+			msgs: []stored{
+				{key: "1.temp", payload: "a"},
+				{key: "1.hum", payload: "b"},
+				{key: "2", payload: "c"},
+			},
+			want:    []string{"b", "c"},
+			dropped: 1,
+		},
+		{
+			desc:      "keep latest uses topic without key",
+			retention: Retention{MaxSize: 4, Overflow: KeepLatest},
+			msgs:      []stored{{payload: "a"}, {payload: "b"}, {payload: "c"}},
+			want:      []string{"c"},
+			dropped:   2,
+		},
+		{
+			desc:      "max age",
+			retention: Retention{MaxAge: time.Hour},
+			msgs:      []stored{{payload: "a", age: 2 * time.Hour}, {payload: "b", age: time.Minute}, {payload: "c"}},
+			want:      []string{"b", "c"},
+			dropped:   1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := newMemCache()
+			dropped := 0
+			rc := NewRetentionCache(c, func(s, reason string, count int) {
+				dropped += count
+			})
+			if err := rc.SetRetention(stream, tc.retention); err != nil {
+				t.Fatalf("unexpected error setting retention: %s", err)
+			}
+			errs := 0
+			for _, m := range tc.msgs {
+				_, err := rc.Add(stream, m.encode())
+				switch err {
+				case nil:
+				case ErrDropped:
+					errs++
+				default:
+					t.Fatalf("unexpected error adding message: %s", err)
+				}
+			}
+			if _, err := rc.Read(stream, 100); err != nil {
+				t.Fatalf("unexpected error reading stream: %s", err)
+			}
+			if got := c.payloads(stream); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected messages %v, got %v", tc.want, got)
+			}
+			if dropped != tc.dropped {
+				t.Errorf("expected %d dropped messages, got %d", tc.dropped, dropped)
+			}
+			if errs != tc.errs {
+				t.Errorf("expected %d dropped errors, got %d", tc.errs, errs)
+			}
+		})
+	}
+}
+
+func TestSetRetention(t *testing.T) {
+	cases := []struct {
+		desc      string
+		retention Retention
+		want      []string
+		err       error
+	}{
+		{
+			desc:      "size applied to stored messages",
+			retention: Retention{MaxSize: 4},
+			want:      []string{"c", "d"},
+		},
+		{
+			desc:      "age applied to stored messages",
+			retention: Retention{MaxAge: 90 * time.Minute},
+			want:      []string{"b", "c", "d"},
+		},
+		{
+			desc:      "no limits",
+			retention: Retention{},
+			want:      []string{"a", "b", "c", "d"},
+		},
+		{
+			desc:      "unknown overflow",
+			retention: Retention{MaxSize: 4, Overflow: "drop_random"},
+			want:      []string{"a", "b", "c", "d"},
+			err:       ErrUnknownOverflow,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := newMemCache()
+			msgs := []stored{
+				{payload: "a", age: 2 * time.Hour},
+				{payload: "b", age: time.Hour},
+				{payload: "c"},
+				{payload: "d"},
+			}
+			for _, m := range msgs {
+				if _, err := c.Add(stream, m.encode()); err != nil {
+					t.Fatalf("unexpected error adding message: %s", err)
+				}
+			}
+			rc := NewRetentionCache(c, nil)
+			if err := rc.SetRetention(stream, tc.retention); err != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if got := c.payloads(stream); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected messages %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRetentionRemove(t *testing.T) {
+	c := newMemCache()
+	rc := NewRetentionCache(c, nil)
+	if err := rc.SetRetention(stream, Retention{MaxSize: 4, Overflow: DropNewest}); err != nil {
+		t.Fatalf("unexpected error setting retention: %s", err)
+	}
+	var ids []string
+	for _, p := range []string{"a", "b"} {
+		id, err := rc.Add(stream, stored{payload: p}.encode())
+		if err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := rc.Add(stream, stored{payload: "c"}.encode()); err != ErrDropped {
+		t.Fatalf("expected error %v, got %v", ErrDropped, err)
+	}
+	// Removed messages make room for the new ones.
+	if err := rc.Remove(stream, ids...); err != nil {
+		t.Fatalf("unexpected error removing messages: %s", err)
+	}
+	if _, err := rc.Add(stream, stored{payload: "d"}.encode()); err != nil {
+		t.Fatalf("unexpected error adding message: %s", err)
+	}
+	if got, want := c.payloads(stream), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected messages %v, got %v", want, got)
+	}
+}
+
+func TestRetentionLoad(t *testing.T) {
+	cases := []struct {
+		desc   string
+		stored int
+	}{
+		{desc: "empty stream", stored: 0},
+		{desc: "single page", stored: loadBatch - 1},
+		{desc: "full page", stored: loadBatch},
+		{desc: "several pages", stored: 2*loadBatch + 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := newMemCache()
+			for i := 0; i < tc.stored; i++ {
+				if _, err := c.Add(stream, stored{payload: "a"}.encode()); err != nil {
+					t.Fatalf("unexpected error adding message: %s", err)
+				}
+			}
+			dropped := 0
+			rc := NewRetentionCache(c, func(s, reason string, count int) {
+				dropped += count
+			})
+			// Every message takes 2 bytes, so all but two are dropped.
+			if err := rc.SetRetention(stream, Retention{MaxSize: 4}); err != nil {
+				t.Fatalf("unexpected error setting retention: %s", err)
+			}
+			want := tc.stored - 2
+			if want < 0 {
+				want = 0
+			}
+			if dropped != want {
+				t.Errorf("expected %d dropped messages, got %d", want, dropped)
+			}
+			if c.maxRead > loadBatch {
+				t.Errorf("expected at most %d messages read at once, got %d", loadBatch, c.maxRead)
+			}
+		})
+	}
+}